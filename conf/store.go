@@ -0,0 +1,48 @@
+package conf
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var storeLock sync.Mutex
+
+// Dir returns the directory of the app config file. Data the plugin keeps between runs is stored there as well.
+func Dir() string {
+	return filepath.Dir(appCfgPath)
+}
+
+// LoadJSON reads the json file with the given name from the config directory into v.
+// A file that doesn't exist yet is not an error and leaves v untouched.
+func LoadJSON(name string, v any) error {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	content, err := os.ReadFile(filepath.Join(Dir(), name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(content, v)
+}
+
+// SaveJSON writes v as json file with the given name into the config directory.
+func SaveJSON(name string, v any) error {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(Dir(), name), content, 0644)
+}
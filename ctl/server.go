@@ -1,15 +1,30 @@
 package ctl
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
+	"github.com/f-taxes/german_tax_report/conf"
+	. "github.com/f-taxes/german_tax_report/global"
 	pb "github.com/f-taxes/german_tax_report/proto"
+	"github.com/f-taxes/german_tax_report/rates"
 	"github.com/kataras/golog"
+	d "github.com/shopspring/decimal"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type PluginCtl struct {
 	pb.UnimplementedPluginCtlServer
+	rates        *rates.Rates
+	ratesModTime time.Time
+	l            sync.Mutex
 }
 
 func Start(address string) {
@@ -25,3 +40,133 @@ func Start(address string) {
 		golog.Fatalf("failed to serve: %v", err)
 	}
 }
+
+// Returns the ECB reference rates from the config directory. The file is read again whenever it changes.
+func (s *PluginCtl) getRates() (*rates.Rates, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	path := filepath.Join(conf.Dir(), rates.ECB_FILE)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.rates == nil || !info.ModTime().Equal(s.ratesModTime) {
+		r, err := rates.Load(path)
+		if err != nil {
+			return nil, err
+		}
+
+		s.rates = r
+		s.ratesModTime = info.ModTime()
+	}
+
+	return s.rates, nil
+}
+
+func (s *PluginCtl) ConvertPricesInTrade(ctx context.Context, job *pb.TradeConversionJob) (*pb.Trade, error) {
+	if job.Trade == nil {
+		return nil, status.Error(codes.InvalidArgument, "no trade to convert")
+	}
+
+	if job.TargetCurrency != "EUR" {
+		return nil, status.Errorf(codes.InvalidArgument, "only conversions to EUR are supported, not %s", job.TargetCurrency)
+	}
+
+	fxRates, err := s.getRates()
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "no reference rates available: %v", err)
+	}
+
+	trade := job.Trade
+	ts := trade.Ts.AsTime()
+	price := D(trade.Price)
+
+	var priceC, quotePriceC d.Decimal
+	var source string
+
+	if quoteEur, day, ok := fxRates.EurPrice(trade.Quote, ts); ok {
+		quotePriceC = quoteEur
+		priceC = price.Mul(quoteEur)
+		source = convertedBy(day)
+	} else if assetEur, day, ok := fxRates.EurPrice(trade.Asset, ts); ok && price.IsPositive() {
+		priceC = assetEur
+		quotePriceC = assetEur.DivRound(price, 8)
+		source = convertedBy(day)
+	} else {
+		return nil, status.Errorf(codes.NotFound, "no reference rate for %s or %s on %s", trade.Asset, trade.Quote, ts.Format(time.DateOnly))
+	}
+
+	trade.PriceC = priceC.String()
+	trade.QuotePriceC = quotePriceC.String()
+	trade.ValueC = D(trade.Value).Mul(quotePriceC).String()
+	trade.PriceConvertedBy = source
+	trade.QuotePriceConvertedBy = source
+
+	// Fees can be payed in either of the traded currencies or in a third one.
+	feePrice := func(currency string) (d.Decimal, string, bool) {
+		switch currency {
+		case trade.Asset:
+			return priceC, source, true
+		case trade.Quote:
+			return quotePriceC, source, true
+		}
+
+		p, day, ok := fxRates.EurPrice(currency, ts)
+		return p, convertedBy(day), ok
+	}
+
+	for _, cost := range append([]*pb.Cost{trade.Fee, trade.QuoteFee}, trade.OtherCosts...) {
+		if cost == nil || cost.Amount == "" {
+			continue
+		}
+
+		if p, by, ok := feePrice(cost.Currency); ok {
+			cost.PriceC = p.String()
+			cost.AmountC = D(cost.Amount).Mul(p).String()
+			cost.ConvertedBy = by
+		}
+	}
+
+	return trade, nil
+}
+
+func (s *PluginCtl) ConvertPricesInTransfer(ctx context.Context, job *pb.TransferConversionJob) (*pb.Transfer, error) {
+	if job.Transfer == nil {
+		return nil, status.Error(codes.InvalidArgument, "no transfer to convert")
+	}
+
+	if job.TargetCurrency != "EUR" {
+		return nil, status.Errorf(codes.InvalidArgument, "only conversions to EUR are supported, not %s", job.TargetCurrency)
+	}
+
+	fxRates, err := s.getRates()
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "no reference rates available: %v", err)
+	}
+
+	transfer := job.Transfer
+
+	if transfer.Fee == "" {
+		return transfer, nil
+	}
+
+	feeCurrency := IfThen(transfer.FeeCurrency != "", transfer.FeeCurrency, transfer.Asset)
+
+	p, day, ok := fxRates.EurPrice(feeCurrency, transfer.Ts.AsTime())
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no reference rate for %s on %s", feeCurrency, transfer.Ts.AsTime().Format(time.DateOnly))
+	}
+
+	transfer.FeePriceC = p.String()
+	transfer.FeeC = D(transfer.Fee).Mul(p).String()
+	transfer.FeeConvertedBy = convertedBy(day)
+
+	return transfer, nil
+}
+
+func convertedBy(day time.Time) string {
+	return fmt.Sprintf("ECB reference rate %s", day.Format(time.DateOnly))
+}
@@ -1,7 +1,7 @@
 package fifo
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
 	"sort"
 	"strings"
@@ -14,6 +14,8 @@ import (
 const (
 	ERR_NO_ENTRY = iota
 	ERR_INSUFFICIENT
+	ERR_STATE_VERSION
+	ERR_INVALID_AMOUNT
 )
 
 type FifoError struct {
@@ -65,6 +67,11 @@ func IsFifoError(err error) bool {
 }
 
 type Entry struct {
+	ID             string // Stable identity of the lot. Lots split off another one get the parent's ID with a counter appended.
+	OriginTxID     string // TxID of the trade or deposit that created the lot.
+	ParentID       string // ID of the lot this one was split off, if any.
+	Splits         int    // Number of lots split off this one so far.
+	PlaceholderID  string // Set for lots of unknown origin that stand in for units taken from an empty queue.
 	Units          d.Decimal
 	UnitsLeft      d.Decimal
 	UnitCost       d.Decimal
@@ -76,6 +83,11 @@ type Entry struct {
 
 func (e *Entry) Copy() Entry {
 	return Entry{
+		ID:             e.ID,
+		OriginTxID:     e.OriginTxID,
+		ParentID:       e.ParentID,
+		Splits:         e.Splits,
+		PlaceholderID:  e.PlaceholderID,
 		Units:          e.Units.Copy(),
 		UnitsLeft:      e.UnitsLeft.Copy(),
 		UnitCost:       e.UnitCost.Copy(),
@@ -118,18 +130,35 @@ func (e EntryList) Copy() EntryList {
 	return n
 }
 
-func NewEntry(amount, valueC, feeC d.Decimal, ts time.Time) Entry {
+// NewEntry creates a lot acquired by the record with the given TxID, which also becomes the lot's ID.
+func NewEntry(originTxID string, amount, valueC, feeC d.Decimal, ts time.Time) Entry {
 	return Entry{
+		ID:             originTxID,
+		OriginTxID:     originTxID,
 		Units:          amount.Copy(),
 		UnitsLeft:      amount.Copy(),
-		UnitCostEur:    valueC.Div(amount).Round(4),
-		UnitFeeCostEur: feeC.Div(amount).Round(4),
+		UnitCostEur:    g.RoundUnitPrice(valueC.Div(amount)),
+		UnitFeeCostEur: g.RoundUnitPrice(feeC.Div(amount)),
 		Ts:             ts,
 	}
 }
 
+// SplitOff returns a new lot holding the given units of this one, linked to it as parent.
+// The units are not deducted from this lot.
+func (e *Entry) SplitOff(units d.Decimal) Entry {
+	e.Splits++
+
+	part := e.Copy()
+	part.ID = fmt.Sprintf("%s.%d", e.ID, e.Splits)
+	part.ParentID = e.ID
+	part.Splits = 0
+	part.UnitsLeft = units
+
+	return part
+}
+
 func (e EntryList) Sort() {
-	sort.Slice(e, func(i, j int) bool {
+	sort.SliceStable(e, func(i, j int) bool {
 		return e[i].Ts.Before(e[j].Ts)
 	})
 }
@@ -137,117 +166,171 @@ func (e EntryList) Sort() {
 func (e EntryList) Print() string {
 	out := []string{}
 	for _, r := range e {
-		out = append(out, fmt.Sprintf("%s | %s (%s left) x %s€ (Fee Total: %s€)", r.Ts, r.Units, r.UnitsLeft, r.UnitCostEur, r.UnitFeeCostEur.Mul(r.Units)))
+		out = append(out, fmt.Sprintf("%s | %s | %s (%s left) x %s€ (Fee Total: %s€)", r.ID, r.Ts, r.Units, r.UnitsLeft, r.UnitCostEur, r.UnitFeeCostEur.Mul(r.Units)))
 	}
 
 	return strings.Join(out, "\n")
 }
 
 type Asset struct {
-	Name    string
-	Total   string
-	Entries EntryList
+	Name     string
+	Total    string
+	Entries  EntryList
+	Residual d.Decimal // Units a take fell short by, which were written off as rounding residual.
 	// baseDir baseDir
 }
 
+// Snapshot is the state of an asset's queue at one point in time. It shares the lots with the queue, they are only
+// copied when the snapshot is read.
+type Snapshot struct {
+	name    string
+	total   string
+	head    Entry
+	hasHead bool
+	rest    EntryList
+}
+
+// Asset returns a copy of the lots in the snapshot.
+func (s Snapshot) Asset() Asset {
+	entries := EntryList{}
+
+	if s.hasHead {
+		entries = make(EntryList, 0, len(s.rest)+1)
+		entries = append(entries, s.head)
+		entries = append(entries, s.rest...)
+	}
+
+	return Asset{
+		Name:    s.name,
+		Total:   s.total,
+		Entries: entries,
+	}
+}
+
+func (s Snapshot) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Asset())
+}
+
+func (s *Snapshot) UnmarshalJSON(data []byte) error {
+	a := Asset{}
+
+	if err := json.Unmarshal(data, &a); err != nil {
+		return err
+	}
+
+	*s = Snapshot{name: a.Name, total: a.Total, rest: EntryList{}}
+
+	if len(a.Entries) > 0 {
+		s.head = a.Entries[0]
+		s.hasHead = true
+		s.rest = a.Entries[1:]
+	}
+
+	return nil
+}
+
+// Fifo holds one queue of lots per asset. Lots are kept ordered by time and taken from the oldest one on.
 type Fifo struct {
-	assets map[string]Asset
+	assets map[string]*queue
 }
 
 func NewFifo() *Fifo {
 	return &Fifo{
-		assets: map[string]Asset{},
+		assets: map[string]*queue{},
 	}
 }
 
 func (f *Fifo) Print() string {
 	out := []string{}
-	for asset, a := range f.assets {
+	for asset, q := range f.assets {
 		out = append(out, fmt.Sprintf("\nFIFO queue for %s:\n", asset))
-		out = append(out, a.Entries.Print())
+		out = append(out, q.live().Print())
 	}
 
 	return strings.Join(out, "\n")
 }
 
 func (f *Fifo) Add(assetName string, e Entry) {
-	if _, ok := f.assets[assetName]; !ok {
-		f.assets[assetName] = Asset{
-			Name:    assetName,
-			Total:   "0",
-			Entries: EntryList{},
-		}
+	q, ok := f.assets[assetName]
+	if !ok {
+		q = newQueue()
+		f.assets[assetName] = q
 	}
 
-	a := f.assets[assetName]
-	a.Entries = append(a.Entries, e)
-	a.Entries.Sort()
-	f.assets[assetName] = a
+	q.insert(e)
+}
+
+// Read returns a copy of the lots that still hold units.
+func (f *Fifo) Read(assetName string) Asset {
+	return f.Snapshot(assetName).Asset()
 }
 
-// func (f *Fifo) Prepend(assetName string, e Entry) {
-// 	if _, ok := f.assets[assetName]; !ok {
-// 		f.assets[assetName] = Asset{
-// 			Name:    assetName,
-// 			Entries: EntryList{},
-// 		}
-// 	}
+// Snapshot returns the state of the queue without copying its lots. Use it to keep the state of a queue around
+// while it keeps changing.
+func (f *Fifo) Snapshot(assetName string) Snapshot {
+	q, ok := f.assets[assetName]
+	if !ok {
+		return Snapshot{total: "0"}
+	}
 
-// 	a := f.assets[assetName]
-// 	a.Entries = append(EntryList{e}, a.Entries...)
-// 	a.Entries.Sort()
-// 	f.assets[assetName] = a
-// }
+	return q.snapshot(assetName)
+}
 
-func (f *Fifo) Read(assetName string) Asset {
-	asset := f.assets[assetName]
-	return Asset{
-		Name:    asset.Name,
-		Total:   asset.Entries.TotalUnitsLeft().String(),
-		Entries: asset.Entries.Copy(),
+// WriteOff removes all units left of the asset from the queue and returns the lots they belonged to.
+func (f *Fifo) WriteOff(assetName string) EntryList {
+	q, ok := f.assets[assetName]
+	if !ok {
+		return EntryList{}
 	}
+
+	out := EntryList{}
+
+	for _, e := range q.live() {
+		if e.UnitsLeft.IsPositive() {
+			out = append(out, e.Copy())
+		}
+	}
+
+	f.assets[assetName] = newQueue()
+
+	return out
 }
 
 func (f *Fifo) HasUnits(assetName string) bool {
-	a, ok := f.assets[assetName]
+	q, ok := f.assets[assetName]
 
 	if !ok {
 		return false
 	}
 
-	if len(a.Entries) == 0 {
-		return false
-	}
+	q.advance()
+
+	return q.hasHead
+}
+
+func (f *Fifo) CouldTake(assetName string, units d.Decimal, decimals int32) bool {
+	q, ok := f.assets[assetName]
 
-	if f.getOldestAvailableEntry(a.Entries) == -1 {
+	if !ok {
 		return false
 	}
 
-	return true
-}
+	units = g.RoundUnits(assetName, units, decimals)
 
-func (f *Fifo) CouldTake(assetName string, units d.Decimal, decimals int32) bool {
-	_, err := f.take(assetName, units, true, decimals)
-	return err == nil
+	return units.Sub(q.total).LessThanOrEqual(g.Precision.ResidualTolerance(assetName, decimals))
 }
 
 func (f *Fifo) Take(assetName string, units d.Decimal, decimals int32) (Asset, error) {
-	return f.take(assetName, units, false, decimals)
-}
-
-func (f *Fifo) take(assetName string, units d.Decimal, simulated bool, decimals int32) (Asset, error) {
-	a, ok := f.assets[assetName]
+	units = g.RoundUnits(assetName, units, decimals)
 
-	if !ok {
-		return Asset{}, NewFifoError(ERR_NO_ENTRY, "no entry for this asset")
+	if units.IsNegative() {
+		return Asset{}, NewFifoError(ERR_INVALID_AMOUNT, fmt.Sprintf("can't take a negative amount of %s %s", units, assetName))
 	}
 
-	units = g.RoundIfFiat(assetName, units)
-
-	entries := a.Entries
+	q, ok := f.assets[assetName]
 
-	if simulated {
-		entries = a.Entries.Copy()
+	if !ok {
+		return Asset{}, NewFifoTakeError(ERR_NO_ENTRY, "no entry for this asset", units.String(), units.String())
 	}
 
 	result := Asset{
@@ -255,54 +338,80 @@ func (f *Fifo) take(assetName string, units d.Decimal, simulated bool, decimals
 		Total:   "0",
 		Entries: EntryList{},
 	}
+
+	if units.IsZero() {
+		return result, nil
+	}
+
 	rest := units.Copy()
 
 	for {
-		if len(entries) == 0 {
-			if rest.GreaterThan(d.Zero) {
-				return result, errors.New("incomplete")
+		q.advance()
+
+		if !q.hasHead {
+			// Shortfalls caused by rounding earlier on are reconciled instead of failing the take.
+			if rest.LessThanOrEqual(g.Precision.ResidualTolerance(assetName, decimals)) {
+				result.Residual = rest
+				result.Total = result.Entries.TotalUnitsLeft().String()
+				return result, nil
 			}
-			break
-		}
 
-		oldestIdx := f.getOldestAvailableEntry(entries)
-
-		if oldestIdx == -1 {
+			result.Total = result.Entries.TotalUnitsLeft().String()
 			return result, NewFifoTakeError(ERR_NO_ENTRY, fmt.Sprintf("insufficient assets in fifo queue to take %s %s (rest=%s)", units, assetName, rest), units.String(), rest.String())
 		}
 
-		oldest := entries[oldestIdx]
-
-		// rest = g.FixRoundingIfFiat(assetName, rest, oldest.UnitsLeft)
+		oldest := &q.head
 
 		if rest.LessThanOrEqual(oldest.UnitsLeft) {
-			r := oldest.Copy()
-			r.UnitsLeft = rest
-			result.Entries = append(result.Entries, r)
-			result.Total = result.Entries.TotalUnitsLeft().String()
+			// Taking a lot only in parts splits it.
+			if rest.LessThan(oldest.UnitsLeft) {
+				result.Entries = append(result.Entries, oldest.SplitOff(rest))
+			} else {
+				result.Entries = append(result.Entries, oldest.Copy())
+			}
 
-			// oldest.UnitsLeft = g.RoundIfFiat(assetName, oldest.UnitsLeft.Sub(rest))
-			oldest.UnitsLeft = oldest.UnitsLeft.Sub(rest).Round(decimals)
-			entries[oldestIdx] = oldest
+			left := oldest.UnitsLeft.Sub(rest)
+			q.total = q.total.Sub(oldest.UnitsLeft).Add(left)
+			oldest.UnitsLeft = left
+			result.Total = result.Entries.TotalUnitsLeft().String()
 
 			return result, nil
-		} else {
-			rest = rest.Sub(oldest.UnitsLeft).Round(decimals)
-			result.Entries = append(result.Entries, oldest.Copy())
-			result.Total = result.Entries.TotalUnitsLeft().String()
-			entries[oldestIdx].UnitsLeft = d.Zero
 		}
-	}
 
-	return result, nil
+		rest = rest.Sub(oldest.UnitsLeft)
+		result.Entries = append(result.Entries, oldest.Copy())
+		q.total = q.total.Sub(oldest.UnitsLeft)
+		q.next()
+	}
 }
 
-func (f *Fifo) getOldestAvailableEntry(entries EntryList) int {
-	for i := range entries {
-		if entries[i].UnitsLeft.GreaterThan(d.Zero) {
-			return i
+// Split divides every entry in the list by the given ratio (0 - 1). The first list holds the split off part
+// of each entry, the second one what is left of it. Both keep the timestamps and costs of the original entries.
+// Split off units are rounded to the given number of decimals, as resolved by the precision policy.
+func (e EntryList) Split(ratio d.Decimal, decimals int32) (EntryList, EntryList) {
+	part := EntryList{}
+	rest := EntryList{}
+
+	for i := range e {
+		r := e[i].Copy()
+		p := r.SplitOff(e[i].UnitsLeft.Mul(ratio).Round(decimals))
+		r.UnitsLeft = e[i].UnitsLeft.Sub(p.UnitsLeft)
+
+		// Nothing was split off if all units went to one side.
+		if r.UnitsLeft.IsZero() {
+			p = e[i].Copy()
+		} else if p.UnitsLeft.IsZero() {
+			r = e[i].Copy()
+		}
+
+		if p.UnitsLeft.GreaterThan(d.Zero) {
+			part = append(part, p)
+		}
+
+		if r.UnitsLeft.GreaterThan(d.Zero) {
+			rest = append(rest, r)
 		}
 	}
 
-	return -1
+	return part, rest
 }
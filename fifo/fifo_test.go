@@ -0,0 +1,233 @@
+package fifo
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	d "github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+var benchStart = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+func entryAt(units string, minute int) Entry {
+	return NewEntry(fmt.Sprintf("%s@%d", units, minute), d.RequireFromString(units), d.RequireFromString(units), d.Zero, benchStart.Add(time.Duration(minute)*time.Minute))
+}
+
+func TestQueue(t *testing.T) {
+	f := NewFifo()
+	f.Add("BTC", entryAt("1", 2))
+	f.Add("BTC", entryAt("2", 0))
+	f.Add("BTC", entryAt("3", 1))
+	f.Add("BTC", entryAt("4", 1))
+
+	// Lots are ordered by time, lots of the same time keep the order they were added in.
+	before := f.Read("BTC")
+	assert.Equal(t, "10", before.Total)
+	assert.Equal(t, []string{"2", "3", "4", "1"}, unitsLeft(before.Entries))
+	snapshot := f.Snapshot("BTC")
+
+	taken, err := f.Take("BTC", d.RequireFromString("6"), 8)
+	assert.NoError(t, err)
+	assert.Equal(t, "6", taken.Total)
+	assert.Equal(t, []string{"2", "3", "1"}, unitsLeft(taken.Entries))
+
+	// Taking a lot in parts splits it, the rest keeps its identity.
+	assert.Equal(t, "4@1.1", taken.Entries[2].ID)
+	assert.Equal(t, "4@1", taken.Entries[2].ParentID)
+	assert.Equal(t, "4@1", taken.Entries[2].OriginTxID)
+	assert.Equal(t, "4@1", f.Read("BTC").Entries[0].ID)
+
+	// Earlier reads and snapshots aren't affected by the take.
+	assert.Equal(t, []string{"2", "3", "4", "1"}, unitsLeft(before.Entries))
+	assert.Equal(t, []string{"2", "3", "4", "1"}, unitsLeft(snapshot.Asset().Entries))
+	assert.Equal(t, 0, snapshot.Asset().Entries[2].Splits)
+
+	after := f.Read("BTC")
+	assert.Equal(t, "4", after.Total)
+	assert.Equal(t, []string{"3", "1"}, unitsLeft(after.Entries))
+
+	// A lot older than the head is taken first.
+	f.Add("BTC", entryAt("5", -1))
+	assert.True(t, f.CouldTake("BTC", d.RequireFromString("9"), 8))
+	assert.False(t, f.CouldTake("BTC", d.RequireFromString("9.1"), 8))
+
+	taken, err = f.Take("BTC", d.RequireFromString("5"), 8)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"5"}, unitsLeft(taken.Entries))
+	assert.Equal(t, benchStart.Add(-time.Minute), taken.Entries[0].Ts)
+
+	_, err = f.Take("BTC", d.RequireFromString("5"), 8)
+	assert.True(t, IsFifoError(err))
+}
+
+func TestSnapshotJSON(t *testing.T) {
+	f := fillFifo(3)
+	snapshot := f.Snapshot("BTC")
+
+	data, err := json.Marshal(snapshot)
+	assert.NoError(t, err)
+
+	restored := Snapshot{}
+	assert.NoError(t, json.Unmarshal(data, &restored))
+	assert.Equal(t, snapshot.Asset().Total, restored.Asset().Total)
+	assert.Equal(t, unitsLeft(snapshot.Asset().Entries), unitsLeft(restored.Asset().Entries))
+
+	again, err := json.Marshal(restored)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(data), string(again))
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	f := NewFifo()
+	f.Add("BTC", entryAt("1", 0))
+	f.Add("BTC", entryAt("2", 1))
+	f.Add("ETH", entryAt("3", 0))
+
+	_, err := f.Take("BTC", d.RequireFromString("1.5"), 8)
+	assert.NoError(t, err)
+
+	data, err := json.Marshal(f.State())
+	assert.NoError(t, err)
+
+	s := State{}
+	assert.NoError(t, json.Unmarshal(data, &s))
+
+	restored, err := FromState(s)
+	assert.NoError(t, err)
+
+	// Decimals may differ in their internal form after the round trip, so they are compared as json.
+	sameJSON := func(want, got any) {
+		wantData, err := json.Marshal(want)
+		assert.NoError(t, err)
+		gotData, err := json.Marshal(got)
+		assert.NoError(t, err)
+		assert.JSONEq(t, string(wantData), string(gotData))
+	}
+
+	for _, asset := range []string{"BTC", "ETH"} {
+		sameJSON(f.Read(asset), restored.Read(asset))
+	}
+
+	// The restored queue continues where the original one left off, including the numbering of split lots.
+	want, err := f.Take("BTC", d.RequireFromString("1"), 8)
+	assert.NoError(t, err)
+	got, err := restored.Take("BTC", d.RequireFromString("1"), 8)
+	assert.NoError(t, err)
+	sameJSON(want, got)
+	assert.Equal(t, "2@1.2", got.Entries[0].ID)
+
+	_, err = FromState(State{Version: STATE_VERSION + 1})
+	assert.True(t, IsFifoError(err))
+}
+
+func TestSplit(t *testing.T) {
+	part, rest := EntryList{entryAt("10", 0), entryAt("4", 1)}.Split(d.RequireFromString("0.25"), 8)
+
+	assert.Equal(t, []string{"2.5", "1"}, unitsLeft(part))
+	assert.Equal(t, []string{"7.5", "3"}, unitsLeft(rest))
+	assert.Equal(t, []string{"10@0.1", "4@1.1"}, []string{part[0].ID, part[1].ID})
+	assert.Equal(t, []string{"10@0", "4@1"}, []string{part[0].ParentID, part[1].ParentID})
+
+	// Splitting what is left again continues the counter of the parent.
+	part, _ = rest.Split(d.RequireFromString("0.5"), 8)
+	assert.Equal(t, "10@0.2", part[0].ID)
+
+	// Nothing is split off if all units go to one side.
+	part, rest = EntryList{entryAt("10", 0)}.Split(d.RequireFromString("1"), 8)
+	assert.Equal(t, "10@0", part[0].ID)
+	assert.Empty(t, rest)
+}
+
+func unitsLeft(entries EntryList) []string {
+	out := []string{}
+
+	for _, e := range entries {
+		out = append(out, e.UnitsLeft.String())
+	}
+
+	return out
+}
+
+func fillFifo(n int) *Fifo {
+	f := NewFifo()
+
+	for i := 0; i < n; i++ {
+		f.Add("BTC", entryAt("1", i))
+	}
+
+	return f
+}
+
+func BenchmarkAdd(b *testing.B) {
+	for _, n := range []int{10_000, 100_000, 1_000_000} {
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				fillFifo(n)
+			}
+		})
+	}
+}
+
+// Takes the whole queue one lot at a time.
+func BenchmarkTake(b *testing.B) {
+	one := d.RequireFromString("1")
+
+	for _, n := range []int{10_000, 100_000, 1_000_000} {
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				f := fillFifo(n)
+				b.StartTimer()
+
+				for j := 0; j < n; j++ {
+					if _, err := f.Take("BTC", one, 8); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// Snapshots share the lots of the queue instead of copying them.
+func BenchmarkSnapshot(b *testing.B) {
+	for _, n := range []int{10_000, 100_000, 1_000_000} {
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			f := fillFifo(n)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				f.Snapshot("BTC")
+			}
+		})
+	}
+}
+
+// Takes the whole queue in parts of lots, with a snapshot before and after each take like a trade records.
+func BenchmarkSnapshotTake(b *testing.B) {
+	half := d.RequireFromString("0.5")
+
+	for _, n := range []int{10_000, 100_000, 1_000_000} {
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				f := fillFifo(n)
+				snapshots := make([]Snapshot, 0, 4*n)
+				b.StartTimer()
+
+				for j := 0; j < 2*n; j++ {
+					snapshots = append(snapshots, f.Snapshot("BTC"))
+
+					if _, err := f.Take("BTC", half, 8); err != nil {
+						b.Fatal(err)
+					}
+
+					snapshots = append(snapshots, f.Snapshot("BTC"))
+				}
+			}
+		})
+	}
+}
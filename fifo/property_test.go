@@ -0,0 +1,178 @@
+package fifo
+
+import (
+	"encoding/json"
+	"math/rand"
+	"testing"
+	"time"
+
+	g "github.com/f-taxes/german_tax_report/global"
+	d "github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	opAdd = iota
+	opTake
+	opTransfer // Takes units from one queue and adds the taken lots to the other.
+)
+
+type op struct {
+	kind  int
+	queue int // Index of the queue the operation works on.
+	units d.Decimal
+	cost  d.Decimal
+	ts    time.Time
+}
+
+// Random amount with up to 8 decimals.
+func randomUnits(rnd *rand.Rand) d.Decimal {
+	return d.New(rnd.Int63n(1_000_000_000)+1, -int32(rnd.Intn(9)))
+}
+
+func randomOps(rnd *rand.Rand, n int) []op {
+	ops := []op{}
+
+	for i := 0; i < n; i++ {
+		ops = append(ops, op{
+			kind:  []int{opAdd, opAdd, opTake, opTransfer}[rnd.Intn(4)],
+			queue: rnd.Intn(2),
+			units: randomUnits(rnd),
+			cost:  d.New(rnd.Int63n(10_000_000), -2),
+			ts:    benchStart.Add(time.Duration(rnd.Intn(10_000)) * time.Minute),
+		})
+	}
+
+	return ops
+}
+
+func costOf(entries EntryList) d.Decimal {
+	total := d.Zero
+
+	for _, e := range entries {
+		total = total.Add(e.UnitCostEur.Mul(e.UnitsLeft))
+	}
+
+	return total
+}
+
+func checkTake(t *testing.T, i int, o op, result Asset, err error) {
+	if err == nil {
+		assert.True(t, result.Entries.TotalUnitsLeft().Add(result.Residual).Equal(o.units), "op %d: took %s instead of %s", i, result.Entries.TotalUnitsLeft(), o.units)
+	}
+
+	for _, e := range result.Entries {
+		assert.False(t, e.UnitsLeft.IsNegative(), "op %d: taken lot %s has negative units", i, e.ID)
+	}
+}
+
+// Runs the operations on two queues and checks the invariants after each of them. Returns the final state of the queues.
+func runOps(t *testing.T, ops []op) []State {
+	queues := []*Fifo{NewFifo(), NewFifo()}
+	added, taken := d.Zero, d.Zero
+	addedCost, takenCost := d.Zero, d.Zero
+
+	for i, o := range ops {
+		f := queues[o.queue]
+
+		switch o.kind {
+		case opAdd:
+			e := NewEntry(o.ts.String(), o.units, o.cost, d.Zero, o.ts)
+			f.Add("BTC", e)
+			added = added.Add(o.units)
+			addedCost = addedCost.Add(costOf(EntryList{e}))
+		case opTake:
+			result, err := f.Take("BTC", o.units, 8)
+			checkTake(t, i, o, result, err)
+			taken = taken.Add(result.Entries.TotalUnitsLeft())
+			takenCost = takenCost.Add(costOf(result.Entries))
+		case opTransfer:
+			snapshot, before := f.Snapshot("BTC"), f.Read("BTC")
+			result, err := f.Take("BTC", o.units, 8)
+			checkTake(t, i, o, result, err)
+
+			for _, e := range result.Entries {
+				queues[1-o.queue].Add("BTC", e)
+			}
+
+			// Snapshots taken before aren't changed by taking from the queue.
+			assert.Equal(t, before, snapshot.Asset(), "op %d: snapshot changed", i)
+		}
+
+		total, cost := d.Zero, d.Zero
+
+		for _, q := range queues {
+			a := q.Read("BTC")
+			total = total.Add(D(a.Total))
+			cost = cost.Add(costOf(a.Entries))
+
+			for j, e := range a.Entries {
+				assert.False(t, e.UnitsLeft.IsNegative(), "op %d: lot %s has negative units", i, e.ID)
+
+				if j > 0 {
+					assert.False(t, e.Ts.Before(a.Entries[j-1].Ts), "op %d: lots are out of order", i)
+				}
+			}
+		}
+
+		// Units and cost basis are conserved, moving lots between queues doesn't change either.
+		assert.True(t, total.Equal(added.Sub(taken)), "op %d: queues hold %s, expected %s", i, total, added.Sub(taken))
+		assert.True(t, cost.Add(takenCost).Equal(addedCost), "op %d: cost basis isn't conserved", i)
+	}
+
+	return []State{queues[0].State(), queues[1].State()}
+}
+
+func D(s string) d.Decimal {
+	return d.RequireFromString(s)
+}
+
+func TestQueueProperties(t *testing.T) {
+	for seed := int64(1); seed <= 50; seed++ {
+		ops := randomOps(rand.New(rand.NewSource(seed)), 500)
+
+		first, err := json.Marshal(runOps(t, ops))
+		require.NoError(t, err)
+
+		// The same operations always result in the same queue.
+		second, err := json.Marshal(runOps(t, ops))
+		require.NoError(t, err)
+		assert.Equal(t, string(first), string(second), "seed %d isn't deterministic", seed)
+	}
+}
+
+func FuzzTake(f *testing.F) {
+	f.Add("1", int32(8))
+	f.Add("0.00000001", int32(8))
+	f.Add("2.5", int32(0))
+	f.Add("10.123456789", int32(4))
+	f.Add("-1", int32(8))
+	f.Add("0", int32(2))
+
+	f.Fuzz(func(t *testing.T, amount string, decimals int32) {
+		units, err := d.NewFromString(amount)
+		if err != nil || decimals < 0 || decimals > 18 || units.Abs().GreaterThan(D("1000000000")) {
+			t.Skip()
+		}
+
+		q := NewFifo()
+		q.Add("BTC", entryAt("1.5", 0))
+		q.Add("BTC", entryAt("0.25", 1))
+		q.Add("BTC", entryAt("3", 2))
+
+		result, err := q.Take("BTC", units, decimals)
+		left := D(q.Read("BTC").Total)
+
+		assert.False(t, left.IsNegative())
+		assert.True(t, left.Add(result.Entries.TotalUnitsLeft()).Equal(D("4.75")), "units aren't conserved taking %s", units)
+
+		for _, e := range result.Entries {
+			assert.True(t, e.UnitsLeft.IsPositive(), "taken lot %s holds %s units", e.ID, e.UnitsLeft)
+		}
+
+		if err == nil && units.IsPositive() {
+			assert.True(t, result.Entries.TotalUnitsLeft().Add(result.Residual).Equal(g.RoundUnits("BTC", units, decimals)))
+		}
+	})
+}
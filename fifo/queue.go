@@ -0,0 +1,109 @@
+package fifo
+
+import (
+	"slices"
+	"sort"
+
+	d "github.com/shopspring/decimal"
+)
+
+// queue holds the lots of a single asset ordered by time. Lots are used up from the front. The oldest lot that
+// may still hold units is kept apart as the head, since it's the only one a take changes. The lots after it are
+// never changed in place once a snapshot shares them, so taking snapshots and taking units never copies the queue.
+type queue struct {
+	head    Entry
+	hasHead bool
+	rest    EntryList // Lots after the head.
+	total   d.Decimal // Sum of the units left in all lots.
+	shared  bool      // rest is referenced by a snapshot, lots must not be inserted into it in place.
+}
+
+func newQueue() *queue {
+	return &queue{
+		rest:  EntryList{},
+		total: d.Zero,
+	}
+}
+
+// Lots from the head on. Used up lots can only follow the head if they were added without units.
+func (q *queue) live() EntryList {
+	if !q.hasHead {
+		return EntryList{}
+	}
+
+	out := make(EntryList, 0, len(q.rest)+1)
+	out = append(out, q.head)
+
+	return append(out, q.rest...)
+}
+
+// Insert a lot after all lots with the same or an earlier time, so lots of the same time stay in the order they were added.
+func (q *queue) insert(e Entry) {
+	q.total = q.total.Add(e.UnitsLeft)
+
+	if !q.hasHead {
+		q.head = e
+		q.hasHead = true
+		return
+	}
+
+	// A lot older than the head becomes the head.
+	if e.Ts.Before(q.head.Ts) {
+		q.rest = slices.Insert(slices.Clone(q.rest), 0, q.head)
+		q.head = e
+		q.shared = false
+		return
+	}
+
+	idx := sort.Search(len(q.rest), func(i int) bool {
+		return q.rest[i].Ts.After(e.Ts)
+	})
+
+	// Appending never writes into the part of rest a snapshot references.
+	if idx == len(q.rest) {
+		q.rest = append(q.rest, e)
+		return
+	}
+
+	if q.shared {
+		q.rest = slices.Clone(q.rest)
+		q.shared = false
+	}
+
+	q.rest = slices.Insert(q.rest, idx, e)
+}
+
+// Move the head on to the next lot. Dropping lots from the front of rest doesn't change them, they are left to
+// the snapshots referencing them.
+func (q *queue) next() {
+	if len(q.rest) == 0 {
+		q.head = Entry{}
+		q.hasHead = false
+		q.rest = EntryList{}
+		return
+	}
+
+	q.head = q.rest[0]
+	q.rest = q.rest[1:]
+}
+
+// Move the head past used up lots.
+func (q *queue) advance() {
+	for q.hasHead && !q.head.UnitsLeft.IsPositive() {
+		q.next()
+	}
+}
+
+// Share the lots with a snapshot. The capacity is limited, so appending to the snapshot can't write into the queue.
+func (q *queue) snapshot(name string) Snapshot {
+	q.advance()
+	q.shared = true
+
+	return Snapshot{
+		name:    name,
+		total:   q.total.String(),
+		head:    q.head,
+		hasHead: q.hasHead,
+		rest:    q.rest[:len(q.rest):len(q.rest)],
+	}
+}
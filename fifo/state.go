@@ -0,0 +1,63 @@
+package fifo
+
+import "encoding/json"
+
+// Version of the serialized queue format. Increase it whenever the format changes in an incompatible way.
+const STATE_VERSION = 1
+
+// State is the serialized form of a queue. It only holds what is needed to rebuild the queue,
+// independent of how the queue is organised in memory.
+type State struct {
+	Version int
+	Assets  map[string]EntryList
+}
+
+func (f *Fifo) State() State {
+	s := State{
+		Version: STATE_VERSION,
+		Assets:  map[string]EntryList{},
+	}
+
+	for name, q := range f.assets {
+		s.Assets[name] = q.live().Copy()
+	}
+
+	return s
+}
+
+// FromState creates a queue from its serialized form.
+func FromState(s State) (*Fifo, error) {
+	if s.Version != STATE_VERSION {
+		return nil, NewFifoError(ERR_STATE_VERSION, "unsupported fifo state version")
+	}
+
+	f := NewFifo()
+
+	for name, entries := range s.Assets {
+		for _, e := range entries {
+			f.Add(name, e)
+		}
+	}
+
+	return f, nil
+}
+
+func (f *Fifo) MarshalJSON() ([]byte, error) {
+	return json.Marshal(f.State())
+}
+
+func (f *Fifo) UnmarshalJSON(data []byte) error {
+	s := State{}
+
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	restored, err := FromState(s)
+	if err != nil {
+		return err
+	}
+
+	*f = *restored
+	return nil
+}
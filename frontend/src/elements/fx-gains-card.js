@@ -0,0 +1,137 @@
+/**
+@license
+Copyright (c) 2024 trading_peter
+This program is available under Apache License Version 2.0
+*/
+
+import { formatTs } from '../helpers/time.js';
+import { LitElement, html, css } from 'lit';
+
+class FxGainsCard extends LitElement {
+  static get styles() {
+    return [
+      css`
+        :host {
+          display: block;
+          width: 100%;
+          padding: 15px 0;
+        }
+
+        .wrap {
+          display: flex;
+          flex-direction: column;
+          background-color: #031331;
+          border-radius: 10px;
+          border: solid 2px transparent;
+        }
+
+        .header {
+          display: flex;
+          flex-direction: row;
+          align-items: center;
+          justify-content: space-between;
+          padding: 10px 20px;
+          border-radius: 10px 10px 0 0;
+          background-color: #0c2553;
+        }
+
+        .details {
+          padding: 10px 20px;
+        }
+
+        .year-rec {
+          display: grid;
+          grid-template-columns: repeat(3, 1fr);
+        }
+
+        .entry-rec {
+          display: grid;
+          grid-template-columns: repeat(6, 1fr);
+        }
+
+        .year-rec + .entry-rec {
+          margin-top: 10px;
+        }
+
+        .empty-message {
+          opacity: 0.6;
+        }
+      `
+    ];
+  }
+
+  render() {
+    const { fxGains } = this;
+    const entries = fxGains?.Entries || [];
+    const years = Object.keys(fxGains?.ByYear || {}).sort();
+
+    return html`
+      <div class="wrap">
+        <div class="header">
+          <div>FX gains</div>
+          <div>${entries.length} lots</div>
+        </div>
+        <div class="details">
+          ${entries.length === 0 ? html`<div class="empty-message">No foreign currencies were disposed.</div>` : html`
+          <div class="year-rec content">
+            <div>
+              <label>Year</label>
+            </div>
+            <div>
+              <label>Gain</label>
+            </div>
+            <div>
+              <label>Taxable gain</label>
+            </div>
+          </div>
+          ${years.map(year => html`
+          <div class="year-rec content">
+            <div>${year}</div>
+            <div>${fxGains.ByYear[year].GainEur}€</div>
+            <div>${fxGains.ByYear[year].TaxableGainEur}€</div>
+          </div>
+          `)}
+          <div class="entry-rec content">
+            <div>
+              <label>Asset</label>
+            </div>
+            <div>
+              <label>Units</label>
+            </div>
+            <div>
+              <label>Acquired</label>
+            </div>
+            <div>
+              <label>Disposed</label>
+            </div>
+            <div>
+              <label>Gain</label>
+            </div>
+            <div>
+              <label>Taxable</label>
+            </div>
+          </div>
+          ${entries.map(entry => html`
+          <div class="entry-rec content" title=${`Lot ${entry.LotID} from ${entry.OriginTxID}, disposed by ${entry.RecID}`}>
+            <div>${entry.Asset}</div>
+            <div>${entry.Units}</div>
+            <div>${formatTs(entry.Acquired)}</div>
+            <div>${formatTs(entry.Disposed)}</div>
+            <div>${entry.GainEur}€</div>
+            <div>${entry.Taxable ? 'Yes' : 'No'}</div>
+          </div>
+          `)}
+          `}
+        </div>
+      </div>
+    `;
+  }
+
+  static get properties() {
+    return {
+      fxGains: { type: Object },
+    };
+  }
+}
+
+window.customElements.define('fx-gains-card', FxGainsCard);
@@ -0,0 +1,130 @@
+/**
+@license
+Copyright (c) 2024 trading_peter
+This program is available under Apache License Version 2.0
+*/
+
+import { formatTs } from '../helpers/time.js';
+import { LitElement, html, css } from 'lit';
+
+class MatchesCard extends LitElement {
+  static get styles() {
+    return [
+      css`
+        :host {
+          display: block;
+          width: 100%;
+          padding: 15px 0;
+        }
+
+        .wrap {
+          display: flex;
+          flex-direction: column;
+          background-color: #031331;
+          border-radius: 10px;
+          border: solid 2px transparent;
+        }
+
+        .header {
+          display: flex;
+          flex-direction: row;
+          align-items: center;
+          justify-content: space-between;
+          padding: 10px 20px;
+          border-radius: 10px 10px 0 0;
+          background-color: #0c2553;
+          cursor: pointer;
+        }
+
+        .details {
+          padding: 10px 20px;
+          max-height: 400px;
+          overflow-y: auto;
+        }
+
+        .match-rec {
+          display: grid;
+          grid-template-columns: 2fr repeat(9, 1fr);
+        }
+      `
+    ];
+  }
+
+  render() {
+    const { matches, open } = this;
+
+    return html`
+      <div class="wrap">
+        <div class="header" @click=${() => this.open = !open}>
+          <div>Lot matches</div>
+          <div>${matches.length} rows</div>
+        </div>
+        ${open ? html`
+        <div class="details">
+          <div class="match-rec content">
+            <div>
+              <label>Record</label>
+            </div>
+            <div>
+              <label>Kind</label>
+            </div>
+            <div>
+              <label>Asset</label>
+            </div>
+            <div>
+              <label>Units</label>
+            </div>
+            <div>
+              <label>Acquired</label>
+            </div>
+            <div>
+              <label>Disposed</label>
+            </div>
+            <div>
+              <label>Cost</label>
+            </div>
+            <div>
+              <label>Proceeds</label>
+            </div>
+            <div>
+              <label>Gain</label>
+            </div>
+            <div>
+              <label>Taxable</label>
+            </div>
+          </div>
+          ${matches.map(match => html`
+          <div class="match-rec content" title=${`Lot ${match.LotID} from ${match.OriginTxID} in ${match.Account}`}>
+            <div>${match.RecID}</div>
+            <div>${match.Kind}</div>
+            <div>${match.Asset}</div>
+            <div>${match.Units}</div>
+            <div>${formatTs(match.Acquired)}</div>
+            <div>${formatTs(match.Disposed)}</div>
+            <div>${match.CostEur}€</div>
+            <div>${match.ProceedsEur}€</div>
+            <div>${match.GainEur}€</div>
+            <div>${match.Taxable ? 'Yes' : 'No'}</div>
+          </div>
+          `)}
+        </div>
+        ` : null}
+      </div>
+    `;
+  }
+
+  static get properties() {
+    return {
+      matches: { type: Array },
+      open: { type: Boolean },
+    };
+  }
+
+  constructor() {
+    super();
+    this.matches = [];
+    this.open = false;
+  }
+}
+
+window.customElements.define('matches-card', MatchesCard);
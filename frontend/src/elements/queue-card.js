@@ -72,7 +72,7 @@ class QueueCard extends LitElement {
             </div>
           </div>
           ${asset.Entries.filter(entry => entry.UnitsLeft > 0).map(entry => html`
-          <div class="queue-rec content">
+          <div class="queue-rec content" title=${`Lot ${entry.ID} from ${entry.OriginTxID}`}>
             <div>
               <div>${entry.UnitsLeft} of ${entry.Units}</div>
             </div>
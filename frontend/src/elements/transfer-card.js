@@ -11,6 +11,15 @@ import icons from '../icons.js';
 import { clipboard } from '@tp/helpers/clipboard.js';
 import { shorten } from '../helpers/misc.js';
 
+// How a deposit was matched with its withdrawal, as set by the report generator.
+const matchLabels = {
+  link: 'Manual link',
+  hash: 'Same transaction hash',
+  heuristic: 'Time and amount',
+  chain: 'Through a wallet without records',
+  inferred: 'Inferred, no matching record',
+};
+
 class TransferCard extends clipboard(LitElement) {
   static get styles() {
     return [
@@ -110,7 +119,7 @@ class TransferCard extends clipboard(LitElement) {
               <tp-icon .icon=${icons['arrow-right']}></tp-icon>
             </div>
             <div>
-              ${entry.Type === 'deposit' ? entry.Account : entry.Destination  || '[Unknown Destination]'}
+              ${entry.Type === 'deposit' ? entry.Account : entry.Destination || (entry.Type === 'dust' ? 'Written off' : '[Unknown Destination]')}
             </div>
           </div>
 
@@ -128,14 +137,24 @@ class TransferCard extends clipboard(LitElement) {
           <div class="line"><label>Fees</label></div>
           <div class="line flex">
             <div>
-              ${entry.Fee !== '0' && entry.Asset !== 'EUR' ? html`
+              ${entry.Fee && entry.Fee !== '0' && entry.Asset !== 'EUR' ? html`
                 -${entry.Fee} ${entry.Asset}
               ` : null}
             </div>
             <div>
-              EUR: ${entry.FeeEur === '0' ? entry.FeeEur : html`-${entry.FeeEur}`}€
+              EUR: ${!entry.FeeEur || entry.FeeEur === '0' ? '0' : html`-${entry.FeeEur}`}€
             </div>
           </div>
+
+          ${entry.Type === 'deposit' && entry.MatchedBy ? html`
+            <div class="line"><label>Matched by</label></div>
+            <div class="line">${matchLabels[entry.MatchedBy] || entry.MatchedBy}</div>
+          ` : null}
+
+          ${entry.Type === 'deposit' && entry.MatchedHash ? html`
+            <div class="line"><label>Tx Hash</label></div>
+            <div class="line"><tp-icon tooltip="Copy Tx Hash" .icon=${icons.copy} @click=${() => this.copy(entry.MatchedHash)}></tp-icon> ${shorten(entry.MatchedHash)}</div>
+          ` : null}
         </div>
         ${entry.Error ? html`
           <div class="error">${entry.Error}</div>
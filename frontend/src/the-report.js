@@ -10,6 +10,8 @@ import '@tp/tp-dropdown/tp-dropdown.js';
 import '@tp/tp-input/tp-input.js';
 import '@lit-labs/virtualizer';
 import './elements/conversion-card.js';
+import './elements/fx-gains-card.js';
+import './elements/matches-card.js';
 import './elements/queue-card.js';
 import './elements/transfer-card.js';
 import shared from './styles/shared.js';
@@ -94,7 +96,7 @@ class TheReport extends fetchMixin(DomQuery(LitElement)) {
   }
 
   render() {
-    const { items, selIdx, selItem, errorCount, warningCount } = this;
+    const { items, selIdx, selItem, errorCount, warningCount, generating, progress, summary, matches } = this;
 
     return html`
       <h2>Create a tax report</h2>
@@ -103,6 +105,15 @@ class TheReport extends fetchMixin(DomQuery(LitElement)) {
           <form>
             <tp-dropdown name="year" .items=${this.listOfYears()} .default=${new Date().getFullYear()}></tp-dropdown>
             <tp-button submit>Generate</tp-button>
+            ${generating ? html`<tp-button @click=${this.cancel}>Cancel</tp-button>` : null}
+            ${generating && progress ? html`<div class="progress">${progress.Percent}% &middot; ${progress.Phase} &middot; ${progress.Streamed} records</div>` : null}
+          </form>
+        </tp-form>
+        <tp-form @submit=${this.openJob}>
+          <form>
+            <tp-dropdown id="jobs" name="job" .items=${this.listOfJobs()}></tp-dropdown>
+            <tp-button submit>Open</tp-button>
+            <tp-button @click=${this.deleteJob}>Delete</tp-button>
           </form>
         </tp-form>
         <div>
@@ -125,6 +136,11 @@ class TheReport extends fetchMixin(DomQuery(LitElement)) {
         </div>
       </div>
 
+      ${summary ? html`
+        <fx-gains-card .fxGains=${summary.FxGains}></fx-gains-card>
+        <matches-card .matches=${matches}></matches-card>
+      ` : null}
+
       <div class="page">
         <div class="report" @click=${this.itemClick}>
           <lit-virtualizer id="virtualList" part="list" scroller .items=${items} .renderItem=${(item, idx) => this.renderItem(item, idx, selIdx === idx)}></lit-virtualizer>
@@ -158,7 +174,7 @@ class TheReport extends fetchMixin(DomQuery(LitElement)) {
       return html`<conversion-card .itemIdx=${idx} ?selected=${selected} .entry=${item}></conversion-card>`;
     }
 
-    if (item.Type === 'deposit' || item.Type === 'withdrawal') {
+    if (item.Type === 'deposit' || item.Type === 'withdrawal' || item.Type === 'dust') {
       return html`<transfer-card .itemIdx=${idx} ?selected=${selected} .entry=${item}></transfer-card>`;
     }
   }
@@ -175,11 +191,17 @@ class TheReport extends fetchMixin(DomQuery(LitElement)) {
       errors: { type: Array },
       errorCount: { type: Number },
       warningCount: { type: Number },
+      generating: { type: Boolean },
+      progress: { type: Object },
+      jobs: { type: Array },
+      summary: { type: Object },
+      matches: { type: Array },
     };
   }
 
   constructor() {
     super();
+    this.jobs = [];
     this.reset();
   }
 
@@ -194,32 +216,130 @@ class TheReport extends fetchMixin(DomQuery(LitElement)) {
     return years.reverse();
   }
 
+  firstUpdated() {
+    this.fetchJobs();
+  }
+
+  async fetchJobs() {
+    const resp = await this.get('/report/jobs');
+
+    if (resp.result) {
+      this.jobs = resp.data;
+    }
+  }
+
   async generate(e) {
     this.reset();
 
     const btn = e.target.submitButton;
     btn.showSpinner();
-    const resp = await this.post('/report/generate', { year: parseInt(e.detail.year, 10) });
+    this.generating = true;
 
-    if (resp.result) {
+    const resp = await this.post('/report/jobs', { year: parseInt(e.detail.year, 10) });
+    const job = resp.result ? await this.waitForJob(resp.data.ID) : null;
+
+    this.generating = false;
+    this.progress = null;
+    this.fetchJobs();
+
+    if (job && job.Status === 'done') {
+      await this.loadJob(job.ID);
       btn.showSuccess();
-      this.items = resp.data;
-
-      for (const item of resp.data) {
-        if (item.Error) {
-          this.errorCount++;
-          if (item.RecID) {
-            this.errors.push(item.RecID);
-          }
+    } else {
+      btn.showError();
+    }
+  }
+
+  // Poll the job until it's no longer running.
+  async waitForJob(id) {
+    for (;;) {
+      await new Promise(resolve => setTimeout(resolve, 1000));
+      const resp = await this.get(`/report/jobs/${id}`);
+
+      if (!resp.result) return null;
+
+      if (resp.data.Status !== 'running') {
+        return resp.data;
+      }
+
+      this.progress = resp.data.Progress;
+    }
+  }
+
+  // Load the records and lot matches of a finished job page by page, along with the totals of its report.
+  async loadJob(id) {
+    this.reset();
+
+    const summary = await this.get(`/report/jobs/${id}/summary`);
+    if (!summary.result) return;
+
+    const items = await this.fetchPages(`/report/jobs/${id}/records`);
+    const matches = await this.fetchPages(`/report/jobs/${id}/matches`);
+    if (!items || !matches) return;
+
+    this.items = items;
+    this.matches = matches;
+    this.summary = summary.data;
+
+    for (const item of items) {
+      if (item.Error) {
+        this.errorCount++;
+        if (item.RecID) {
+          this.errors.push(item.RecID);
         }
       }
-    } else {
+    }
+  }
+
+  // Fetch all items of a paged endpoint. Returns null if a page fails to load.
+  async fetchPages(url) {
+    const items = [];
+
+    for (;;) {
+      const resp = await this.get(`${url}?offset=${items.length}`);
+      if (!resp.result) return null;
+
+      items.push(...resp.data.Items);
+
+      if (resp.data.Items.length === 0 || items.length >= resp.data.Total) return items;
+    }
+  }
+
+  async openJob(e) {
+    const btn = e.target.submitButton;
+
+    if (!e.detail.job) {
       btn.showError();
+      return;
     }
+
+    btn.showSpinner();
+    await this.loadJob(e.detail.job);
+    btn.showSuccess();
+  }
+
+  async deleteJob() {
+    const id = this.shadowRoot.querySelector('#jobs').value;
+    if (!id) return;
+
+    await this.post('/report/jobs/delete', { id });
+    this.fetchJobs();
+  }
+
+  listOfJobs() {
+    return this.jobs
+      .filter(job => job.Status === 'done')
+      .map(job => ({ label: `${job.Year} (${new Date(job.Created).toLocaleString()})`, value: job.ID }));
+  }
+
+  async cancel() {
+    await this.post('/report/cancel', {});
   }
 
   reset() {
     this.items = [];
+    this.summary = null;
+    this.matches = [];
     this.errors = [];
     this.errorCount = 0;
     this.warningCount = 0;
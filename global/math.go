@@ -14,32 +14,16 @@ func D(str string, defValue ...decimal.Decimal) decimal.Decimal {
 	return d
 }
 
-func PercentageDelta(n1, n2 decimal.Decimal) decimal.Decimal {
-	return n1.Sub(n2).Abs().Div(n2).Mul(decimal.NewFromInt(100))
-}
-
-func RoundIfFiat(currency string, v decimal.Decimal) decimal.Decimal {
-	switch currency {
-	case "USD", "EUR":
-		v = v.Round(4)
-		if v.LessThanOrEqual(D("0.0001")) {
-			return decimal.Zero
-		}
-		return v
-	default:
-		return v
+// DOk parses the string into a decimal and reports whether it held a valid number.
+func DOk(str string) (decimal.Decimal, bool) {
+	d, err := decimal.NewFromString(str)
+	if err != nil {
+		return decimal.Zero, false
 	}
+
+	return d, true
 }
 
-func FixRoundingIfFiat(currency string, v, should decimal.Decimal) decimal.Decimal {
-	switch currency {
-	case "USD", "EUR":
-		r := v.Sub(should).Abs()
-		if r.LessThanOrEqual(D("0.0001")) {
-			return should
-		}
-		return v
-	default:
-		return v
-	}
+func PercentageDelta(n1, n2 decimal.Decimal) decimal.Decimal {
+	return n1.Sub(n2).Abs().Div(n2).Mul(decimal.NewFromInt(100))
 }
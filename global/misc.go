@@ -1,5 +1,10 @@
 package global
 
+import (
+	"regexp"
+	"strings"
+)
+
 func RemoveElementUnordered[T any](a []T, i int) []T {
 	a[i] = a[len(a)-1]    // Copy last element to index i.
 	a[len(a)-1] = *new(T) // Erase last element (write zero value).
@@ -18,3 +23,34 @@ func IfThen[T any](cond bool, thenVal, elseVal T) T {
 func IsFiatCurrency(currency string) bool {
 	return FiatCurrencies[currency]
 }
+
+// IsCash reports whether the currency is cash for tax purposes. Only EUR is, any other fiat currency is a private asset under §23 EStG.
+func IsCash(currency string) bool {
+	return currency == "EUR"
+}
+
+// IsForeignCurrency reports whether the currency is fiat, but not EUR.
+func IsForeignCurrency(currency string) bool {
+	return IsFiatCurrency(currency) && !IsCash(currency)
+}
+
+var txHashPattern = regexp.MustCompile(`\b(?:0x)?([0-9a-fA-F]{64})\b`)
+
+// FindTxHash returns the first on-chain transaction hash found in the given strings.
+// The hash is returned in lower case and without a "0x" prefix, so that hashes from different sources can be compared.
+func FindTxHash(values ...string) string {
+	for _, v := range values {
+		if m := txHashPattern.FindStringSubmatch(v); m != nil {
+			return strings.ToLower(m[1])
+		}
+	}
+
+	return ""
+}
+
+var addressPattern = regexp.MustCompile(`^[0-9a-zA-Z]{25,}$`)
+
+// LooksLikeAddress reports whether the string is probably a raw wallet address rather than the name of an account.
+func LooksLikeAddress(s string) bool {
+	return addressPattern.MatchString(s)
+}
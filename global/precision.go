@@ -0,0 +1,57 @@
+package global
+
+import "github.com/shopspring/decimal"
+
+// PrecisionPolicy defines how many decimals are kept for each kind of value. It is applied by the fifo queues and the report alike,
+// so that values that are supposed to add up actually do.
+type PrecisionPolicy struct {
+	Units        map[string]int32 // Decimals for units of specific assets. Takes precedence over the decimals given by records.
+	DefaultUnits int32            // Decimals for units of assets the records don't specify decimals for.
+	FiatUnits    int32            // Decimals for units of fiat currencies the records don't specify decimals for.
+	Eur          int32            // Decimals for amounts in EUR.
+	UnitPrice    int32            // Decimals for EUR prices per unit.
+	MaxResidual  int64            // Maximum number of smallest units a take may fall short, which is written off as rounding residual.
+}
+
+var Precision = PrecisionPolicy{
+	Units:        map[string]int32{},
+	DefaultUnits: 8,
+	FiatUnits:    4,
+	Eur:          4,
+	UnitPrice:    8,
+	MaxResidual:  10,
+}
+
+// UnitDecimals returns the number of decimals for units of the asset. Decimals is the number given by a record, if any.
+func (p PrecisionPolicy) UnitDecimals(asset string, decimals int32) int32 {
+	if v, ok := p.Units[asset]; ok {
+		return v
+	}
+
+	if decimals > 0 {
+		return decimals
+	}
+
+	if IsFiatCurrency(asset) {
+		return p.FiatUnits
+	}
+
+	return p.DefaultUnits
+}
+
+// ResidualTolerance returns the largest shortfall of units that is treated as rounding residual.
+func (p PrecisionPolicy) ResidualTolerance(asset string, decimals int32) decimal.Decimal {
+	return decimal.New(p.MaxResidual, -p.UnitDecimals(asset, decimals))
+}
+
+func RoundUnits(asset string, v decimal.Decimal, decimals int32) decimal.Decimal {
+	return v.Round(Precision.UnitDecimals(asset, decimals))
+}
+
+func RoundEur(v decimal.Decimal) decimal.Decimal {
+	return v.Round(Precision.Eur)
+}
+
+func RoundUnitPrice(v decimal.Decimal) decimal.Decimal {
+	return v.Round(Precision.UnitPrice)
+}
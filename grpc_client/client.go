@@ -59,6 +59,8 @@ func (c *FTaxesClient) ShowJobProgress(ctx context.Context, job *proto.JobProgre
 	return err
 }
 
+// Streams the records of a job into out until all records are received. Returns early with the error if the stream
+// breaks or the context is cancelled.
 func (c *FTaxesClient) StreamRecords(ctx context.Context, job *proto.StreamRecordsJob, out chan *proto.Record) error {
 	stream, err := c.GrpcClient.StreamRecords(ctx, job)
 
@@ -66,30 +68,25 @@ func (c *FTaxesClient) StreamRecords(ctx context.Context, job *proto.StreamRecor
 		return err
 	}
 
-	done := make(chan bool)
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
 
-	go func() {
-		for {
-			resp, err := stream.Recv()
-			if err == io.EOF {
-				done <- true
-				return
-			}
-
-			if err != nil {
-				golog.Errorf("Error while streaming records: %v", err)
-				return
-			}
-
-			out <- resp
+		if err != nil {
+			return err
 		}
-	}()
 
-	<-done
-	return nil
+		select {
+		case out <- resp:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
 
 func (c *FTaxesClient) PluginHeartbeat(ctx context.Context) error {
-	_, err := c.GrpcClient.PluginHeartbeat(ctx, &proto.PluginInfo{ID: global.Plugin.ID, Version: global.Plugin.Version})
+	_, err := c.GrpcClient.PluginHeartbeat(ctx, &proto.PluginInfo{ID: global.Plugin.ID, Version: global.Plugin.Version, HasCtlServer: global.Plugin.Ctl.Address != ""})
 	return err
 }
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/f-taxes/german_tax_report/conf"
+	"github.com/f-taxes/german_tax_report/ctl"
 	"github.com/f-taxes/german_tax_report/global"
 	g "github.com/f-taxes/german_tax_report/grpc_client"
 	"github.com/f-taxes/german_tax_report/web"
@@ -55,7 +56,7 @@ func main() {
 
 	conf.LoadAppConfig("config.yaml")
 
-	web.Start(global.Plugin.Web.Address, WebAssets)
+	go ctl.Start(global.Plugin.Ctl.Address)
 
-	// ctl.Start(global.Plugin.Ctl.Address)
+	web.Start(global.Plugin.Web.Address, WebAssets)
 }
@@ -0,0 +1,184 @@
+package prices
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	d "github.com/shopspring/decimal"
+)
+
+// Name of the directory next to the config file that holds one csv file of daily EUR prices per asset.
+const DIR = "prices"
+
+// Number of days to look back if there's no price for a day.
+const maxLookBack = 7
+
+// Prices holds daily EUR prices of assets.
+type Prices struct {
+	assets map[string]map[string]d.Decimal
+}
+
+func New() *Prices {
+	return &Prices{
+		assets: map[string]map[string]d.Decimal{},
+	}
+}
+
+// Load reads all price files from the directory. Each file is named after its asset, like "BTC.csv".
+func Load(dir string) (*Prices, error) {
+	p := New()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.csv"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+
+		asset := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		err = p.Import(asset, f)
+		f.Close()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// Import reads daily prices of an asset from csv. The first column holds the date (YYYY-MM-DD), the second one the price in EUR.
+// Rows that can't be parsed, like a header, are skipped.
+func (p *Prices) Import(asset string, r io.Reader) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	days := map[string]d.Decimal{}
+
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if len(row) < 2 {
+			continue
+		}
+
+		day, err := time.Parse(time.DateOnly, strings.TrimSpace(row[0]))
+		if err != nil {
+			continue
+		}
+
+		price, err := d.NewFromString(strings.TrimSpace(row[1]))
+		if err != nil || price.IsNegative() {
+			continue
+		}
+
+		days[day.Format(time.DateOnly)] = price
+	}
+
+	if len(days) == 0 {
+		return errors.New("no prices found")
+	}
+
+	if _, ok := p.assets[asset]; !ok {
+		p.assets[asset] = map[string]d.Decimal{}
+	}
+
+	for day, price := range days {
+		p.assets[asset][day] = price
+	}
+
+	return nil
+}
+
+// Price returns the EUR price of the asset on the day of ts, along with the day the price is from.
+// If there's no price for that day, the most recent price of the preceding days is used.
+func (p *Prices) Price(asset string, ts time.Time) (d.Decimal, time.Time, bool) {
+	day := ts.UTC().Truncate(time.Hour * 24)
+
+	if p == nil {
+		return d.Zero, day, false
+	}
+
+	for i := 0; i <= maxLookBack; i++ {
+		if price, ok := p.assets[asset][day.Format(time.DateOnly)]; ok {
+			return price, day, true
+		}
+
+		day = day.AddDate(0, 0, -1)
+	}
+
+	return d.Zero, day, false
+}
+
+// Coverage describes for which days prices of an asset are available.
+type Coverage struct {
+	Asset string `json:"asset"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Days  int    `json:"days"`
+}
+
+// Coverage lists all assets with the range of days prices are available for.
+func (p *Prices) Coverage() []Coverage {
+	out := []Coverage{}
+
+	for asset, days := range p.assets {
+		keys := []string{}
+
+		for day := range days {
+			keys = append(keys, day)
+		}
+
+		sort.Strings(keys)
+		out = append(out, Coverage{Asset: asset, From: keys[0], To: keys[len(keys)-1], Days: len(keys)})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Asset < out[j].Asset
+	})
+
+	return out
+}
+
+// Write exports the daily prices of an asset as csv, in the same format Import reads.
+func (p *Prices) Write(asset string, w io.Writer) error {
+	days := []string{}
+
+	for day := range p.assets[asset] {
+		days = append(days, day)
+	}
+
+	sort.Strings(days)
+
+	writer := csv.NewWriter(w)
+
+	if err := writer.Write([]string{"date", "price"}); err != nil {
+		return err
+	}
+
+	for _, day := range days {
+		if err := writer.Write([]string{day, p.assets[asset][day].String()}); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,76 @@
+package prices
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func day(s string) time.Time {
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		panic(err)
+	}
+
+	return t.Add(15 * time.Hour)
+}
+
+func TestImport(t *testing.T) {
+	p := New()
+	require.NoError(t, p.Import("BTC", strings.NewReader("date,price\n2024-01-01,40000\n2024-01-02, 41000.5 \nnot a date,1\n2024-01-03,-5\n2024-01-04\n")))
+
+	price, _, ok := p.Price("BTC", day("2024-01-02"))
+	assert.True(t, ok)
+	assert.Equal(t, "41000.5", price.String())
+
+	// Negative prices are skipped like any other row that can't be parsed.
+	price, from, ok := p.Price("BTC", day("2024-01-03"))
+	assert.True(t, ok)
+	assert.Equal(t, "41000.5", price.String())
+	assert.Equal(t, "2024-01-02", from.Format(time.DateOnly))
+
+	// Importing again merges the prices.
+	require.NoError(t, p.Import("BTC", strings.NewReader("2024-01-02,42000\n2024-01-05,43000\n")))
+	assert.Equal(t, []Coverage{{Asset: "BTC", From: "2024-01-01", To: "2024-01-05", Days: 3}}, p.Coverage())
+
+	assert.Error(t, p.Import("ETH", strings.NewReader("date,price\n")))
+	assert.Equal(t, 1, len(p.Coverage()))
+}
+
+func TestPriceLookBack(t *testing.T) {
+	p := New()
+	require.NoError(t, p.Import("BTC", strings.NewReader("2024-01-01,40000\n")))
+
+	price, from, ok := p.Price("BTC", day("2024-01-08"))
+	assert.True(t, ok)
+	assert.Equal(t, "40000", price.String())
+	assert.Equal(t, "2024-01-01", from.Format(time.DateOnly))
+
+	_, _, ok = p.Price("BTC", day("2024-01-09"))
+	assert.False(t, ok)
+
+	_, _, ok = p.Price("ETH", day("2024-01-01"))
+	assert.False(t, ok)
+
+	// Without a price database nothing is found.
+	var none *Prices
+	_, _, ok = none.Price("BTC", day("2024-01-01"))
+	assert.False(t, ok)
+}
+
+func TestWrite(t *testing.T) {
+	p := New()
+	require.NoError(t, p.Import("BTC", strings.NewReader("2024-01-02,41000\n2024-01-01,40000\n")))
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, p.Write("BTC", buf))
+	assert.Equal(t, "date,price\n2024-01-01,40000\n2024-01-02,41000\n", buf.String())
+
+	restored := New()
+	require.NoError(t, restored.Import("BTC", buf))
+	assert.Equal(t, p.Coverage(), restored.Coverage())
+}
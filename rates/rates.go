@@ -0,0 +1,125 @@
+package rates
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	d "github.com/shopspring/decimal"
+)
+
+// Name of the file with the ECB reference rates, as published at https://www.ecb.europa.eu/stats/eurofxref/eurofxref-hist.zip
+const ECB_FILE = "eurofxref-hist.csv"
+
+// Number of days to look back if there is no rate for a day. The ECB doesn't publish rates on weekends and holidays.
+const maxLookBack = 7
+
+var cet = loadCET()
+
+func loadCET() *time.Location {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// Rates holds daily EUR reference rates. Each rate is the amount of the currency one EUR buys.
+type Rates struct {
+	days map[string]map[string]d.Decimal
+}
+
+// Load reads the reference rates from a csv file in the format the ECB publishes them.
+func Load(path string) (*Rates, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Parse(f)
+}
+
+// Parse reads reference rates in the csv format of the ECB. The first column holds the date, every other column the rates of one currency.
+func Parse(r io.Reader) (*Rates, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(header) < 2 || strings.TrimSpace(header[0]) != "Date" {
+		return nil, errors.New("not an ECB reference rate file")
+	}
+
+	rates := &Rates{
+		days: map[string]map[string]d.Decimal{},
+	}
+
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		day := map[string]d.Decimal{}
+
+		for i := 1; i < len(row) && i < len(header); i++ {
+			rate, err := d.NewFromString(strings.TrimSpace(row[i]))
+			if err != nil || !rate.IsPositive() {
+				continue
+			}
+
+			day[strings.TrimSpace(header[i])] = rate
+		}
+
+		rates.days[strings.TrimSpace(row[0])] = day
+	}
+
+	return rates, nil
+}
+
+// Rate returns the reference rate of the currency for the day of ts, along with the day the rate was published.
+// If there's no rate for that day, the most recent rate of the preceding days is used.
+func (r *Rates) Rate(currency string, ts time.Time) (d.Decimal, time.Time, bool) {
+	day := ts.In(cet)
+	day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, cet)
+
+	if currency == "EUR" {
+		return d.NewFromInt(1), day, true
+	}
+
+	if r == nil {
+		return d.Zero, day, false
+	}
+
+	for i := 0; i <= maxLookBack; i++ {
+		if rate, ok := r.days[day.Format(time.DateOnly)][currency]; ok {
+			return rate, day, true
+		}
+
+		day = day.AddDate(0, 0, -1)
+	}
+
+	return d.Zero, day, false
+}
+
+// EurPrice returns the price in EUR of one unit of the currency on the day of ts.
+func (r *Rates) EurPrice(currency string, ts time.Time) (d.Decimal, time.Time, bool) {
+	rate, day, ok := r.Rate(currency, ts)
+
+	if !ok {
+		return d.Zero, day, false
+	}
+
+	return d.NewFromInt(1).DivRound(rate, 8), day, true
+}
@@ -0,0 +1,31 @@
+package reporting
+
+import "strings"
+
+// AddressBook maps addresses of our own wallets to the names of the accounts they belong to.
+type AddressBook map[string]string
+
+func NewAddressBook(entries map[string]string) AddressBook {
+	book := AddressBook{}
+
+	for address, account := range entries {
+		book[strings.ToLower(address)] = account
+	}
+
+	return book
+}
+
+// Account returns the name of the account the address belongs to.
+func (a AddressBook) Account(address string) (string, bool) {
+	account, ok := a[strings.ToLower(address)]
+	return account, ok
+}
+
+// Resolve returns the account name for known addresses and anything else unchanged.
+func (a AddressBook) Resolve(destination string) string {
+	if account, ok := a.Account(destination); ok {
+		return account
+	}
+
+	return destination
+}
@@ -0,0 +1,247 @@
+package reporting
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/f-taxes/german_tax_report/fifo"
+	. "github.com/f-taxes/german_tax_report/global"
+	"github.com/f-taxes/german_tax_report/proto"
+	d "github.com/shopspring/decimal"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Version of the checkpoint format. Checkpoints of other versions are rejected.
+const CHECKPOINT_VERSION = 1
+
+// Checkpoint is the state of the generator at the start of a year. Generation can be resumed from it,
+// so that only records from that year onward have to be streamed again.
+// It becomes stale as soon as older records, links, classifications or opening balances change.
+type Checkpoint struct {
+	Version           int
+	Year              int
+	From              time.Time // Start of the year. Records from here onward are not part of the checkpoint.
+	Created           time.Time
+	Ordering          string // Order the records were processed in. Checkpoints taken with another ordering are rejected.
+	Inputs            string // Hash of the settings the state was derived from, see inputsHash. Checkpoints taken with other settings are rejected.
+	Accounts          AccountFifo
+	Withdrawals       []withdrawalState
+	PendingDeposits   []pendingDepositState
+	MarginShortTrades map[string]bool
+	Residuals         []Residual
+	Placeholders      []*placeholder
+	Settlements       map[string]fifo.EntryList
+}
+
+// withdrawalState exposes what a withdrawal keeps to itself for matching it with deposits later.
+type withdrawalState struct {
+	Withdrawal  *Withdrawal
+	Remaining   fifo.EntryList
+	Unclaimed   d.Decimal
+	ToOwnWallet bool
+}
+
+type pendingDepositState struct {
+	Deposit       *Deposit
+	Transfer      json.RawMessage // The transfer in its protobuf json form.
+	PlaceholderID string
+}
+
+var taxLocation = loadTaxLocation()
+
+func loadTaxLocation() *time.Location {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// Start of the given year in German time.
+func YearStart(year int) time.Time {
+	return time.Date(year, time.January, 1, 0, 0, 0, 0, taxLocation)
+}
+
+// CheckpointFile is the name of the file in the config directory the checkpoint for the start of year is kept in.
+func CheckpointFile(year int) string {
+	return fmt.Sprintf("checkpoint-%d.json", year)
+}
+
+// Take a checkpoint whenever a record is the first one of a new year.
+func (r *Generator) checkpointAt(ts time.Time) {
+	year := ts.In(taxLocation).Year()
+
+	if r.lastYear != 0 && year > r.lastYear {
+		cp, err := r.checkpoint(year)
+		if err != nil {
+			r.checkpointErr = err
+		} else {
+			r.checkpoints[year] = cp
+		}
+	}
+
+	r.lastYear = year
+}
+
+// Hash of everything besides the records the state depends on. Changing any of it makes checkpoints stale.
+// Reference rates are left out, the rates of past days don't change once they are published.
+func (r *Generator) inputsHash() (string, error) {
+	h := sha256.New()
+
+	settings := struct {
+		Links               TransferLinks
+		Classes             WithdrawalClasses
+		OpeningBalances     OpeningBalances
+		AddressBook         AddressBook
+		DustThresholds      map[string]d.Decimal
+		NegativeBalances    bool
+		PlaceholderFallback string
+		Precision           PrecisionPolicy
+	}{r.Links, r.Classes, r.OpeningBalances, r.AddressBook, r.DustThresholds, r.NegativeBalances, r.PlaceholderFallback, Precision}
+
+	if err := json.NewEncoder(h).Encode(settings); err != nil {
+		return "", err
+	}
+
+	if r.Prices != nil {
+		for _, c := range r.Prices.Coverage() {
+			io.WriteString(h, c.Asset)
+
+			if err := r.Prices.Write(c.Asset, h); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Serialize the current state. The state keeps changing after this, so it is marshalled right away.
+func (r *Generator) checkpoint(year int) ([]byte, error) {
+	inputs, err := r.inputsHash()
+	if err != nil {
+		return nil, err
+	}
+
+	cp := Checkpoint{
+		Version:           CHECKPOINT_VERSION,
+		Year:              year,
+		From:              YearStart(year),
+		Created:           time.Now(),
+		Ordering:          RECORD_ORDERING,
+		Inputs:            inputs,
+		Accounts:          r.accounts,
+		Withdrawals:       []withdrawalState{},
+		PendingDeposits:   []pendingDepositState{},
+		MarginShortTrades: r.marginShortTrades,
+		Residuals:         r.residuals,
+		Placeholders:      r.placeholders,
+		Settlements:       r.settlements,
+	}
+
+	for _, w := range r.recentWithdrawals {
+		cp.Withdrawals = append(cp.Withdrawals, withdrawalState{
+			Withdrawal:  w,
+			Remaining:   w.remaining,
+			Unclaimed:   w.unclaimed,
+			ToOwnWallet: w.toOwnWallet,
+		})
+	}
+
+	for _, p := range r.pendingDeposits {
+		transfer, err := protojson.Marshal(p.transfer)
+		if err != nil {
+			return nil, err
+		}
+
+		cp.PendingDeposits = append(cp.PendingDeposits, pendingDepositState{Deposit: p.deposit, Transfer: transfer, PlaceholderID: p.placeholderID})
+	}
+
+	return json.Marshal(cp)
+}
+
+// Checkpoints returns the checkpoints taken during the last run, serialized and keyed by year.
+func (r *Generator) Checkpoints() (map[int][]byte, error) {
+	return r.checkpoints, r.checkpointErr
+}
+
+// Resume restores the state from a checkpoint. Start then only has to be called with the checkpoint's From time.
+func (r *Generator) Resume(data []byte) (*Checkpoint, error) {
+	cp := Checkpoint{}
+
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, err
+	}
+
+	if cp.Version != CHECKPOINT_VERSION {
+		return nil, fmt.Errorf("unsupported checkpoint version %d", cp.Version)
+	}
+
+	if cp.Ordering != RECORD_ORDERING {
+		return nil, fmt.Errorf("checkpoint was taken with record ordering %q instead of %q", cp.Ordering, RECORD_ORDERING)
+	}
+
+	inputs, err := r.inputsHash()
+	if err != nil {
+		return nil, err
+	}
+
+	if cp.Inputs != inputs {
+		return nil, errors.New("checkpoint was taken with other links, classifications, opening balances, prices or settings")
+	}
+
+	r.accounts = AccountFifo{}
+	r.marginShortTrades = map[string]bool{}
+	r.residuals = []Residual{}
+
+	if cp.Accounts != nil {
+		r.accounts = cp.Accounts
+	}
+
+	if cp.MarginShortTrades != nil {
+		r.marginShortTrades = cp.MarginShortTrades
+	}
+
+	if cp.Residuals != nil {
+		r.residuals = cp.Residuals
+	}
+
+	if cp.Placeholders != nil {
+		r.placeholders = cp.Placeholders
+	}
+
+	if cp.Settlements != nil {
+		r.settlements = cp.Settlements
+	}
+
+	r.recentWithdrawals = []*Withdrawal{}
+	r.pendingDeposits = []*pendingDeposit{}
+
+	for _, s := range cp.Withdrawals {
+		w := s.Withdrawal
+		w.remaining = s.Remaining
+		w.unclaimed = s.Unclaimed
+		w.toOwnWallet = s.ToOwnWallet
+		r.recentWithdrawals = append(r.recentWithdrawals, w)
+	}
+
+	for _, s := range cp.PendingDeposits {
+		transfer := &proto.Transfer{}
+
+		if err := protojson.Unmarshal(s.Transfer, transfer); err != nil {
+			return nil, err
+		}
+
+		r.pendingDeposits = append(r.pendingDeposits, &pendingDeposit{deposit: s.Deposit, transfer: transfer, placeholderID: s.PlaceholderID})
+	}
+
+	r.lastYear = cp.Year
+	r.resumed = true
+
+	return &cp, nil
+}
@@ -0,0 +1,184 @@
+package reporting
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/f-taxes/german_tax_report/global"
+	"github.com/f-taxes/german_tax_report/prices"
+	"github.com/f-taxes/german_tax_report/proto"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func checkpointTransfer(id string, ts time.Time, action proto.TransferAction, account, destination, asset, amount string) *proto.Record {
+	return &proto.Record{Transfer: &proto.Transfer{TxID: id, Ts: timestamppb.New(ts), Account: account, Destination: destination, Asset: asset, Amount: amount, AssetDecimals: 8, Action: action}}
+}
+
+// Records spanning three years. Some state is carried across each year boundary: a placeholder and a withdrawal
+// in transit into 2022, a settlement and a deposit recorded before its withdrawal into 2023.
+func checkpointRecords() []*proto.Record {
+	units := decimal.RequireFromString
+
+	return []*proto.Record{
+		checkpointTransfer("eur", time.Date(2021, time.June, 1, 10, 0, 0, 0, time.UTC), proto.TransferAction_DEPOSIT, "A", "", "EUR", "10000"),
+		propertyTrade("buy-a", time.Date(2021, time.June, 2, 10, 0, 0, 0, time.UTC), "A", proto.TxAction_BUY, units("0.2"), units("30000")),
+		propertyTrade("sell-b", time.Date(2021, time.July, 1, 10, 0, 0, 0, time.UTC), "B", proto.TxAction_SELL, units("0.2"), units("35000")),
+		checkpointTransfer("w-b", time.Date(2021, time.December, 31, 22, 50, 0, 0, time.UTC), proto.TransferAction_WITHDRAWAL, "A", "B", "BTC", "0.05"),
+		checkpointTransfer("d-b", time.Date(2021, time.December, 31, 23, 2, 0, 0, time.UTC), proto.TransferAction_DEPOSIT, "B", "", "BTC", "0.05"),
+		propertyTrade("buy-b", time.Date(2022, time.March, 1, 10, 0, 0, 0, time.UTC), "B", proto.TxAction_BUY, units("0.2"), units("25000")),
+		checkpointTransfer("d-c", time.Date(2022, time.December, 31, 22, 55, 0, 0, time.UTC), proto.TransferAction_DEPOSIT, "C", "", "BTC", "0.01"),
+		checkpointTransfer("w-c", time.Date(2022, time.December, 31, 23, 5, 0, 0, time.UTC), proto.TransferAction_WITHDRAWAL, "A", "C", "BTC", "0.01"),
+		propertyTrade("sell-a", time.Date(2023, time.May, 1, 10, 0, 0, 0, time.UTC), "A", proto.TxAction_SELL, units("0.1"), units("28000")),
+		propertyTrade("sell-c", time.Date(2023, time.June, 1, 10, 0, 0, 0, time.UTC), "C", proto.TxAction_SELL, units("0.02"), units("29000")),
+	}
+}
+
+func checkpointGenerator() *Generator {
+	r := NewGenerator()
+	r.NegativeBalances = true
+
+	return r
+}
+
+// Process the records from the given time on and finish the run like Start does.
+func runFrom(r *Generator, recs []*proto.Record, from time.Time) {
+	for _, rec := range recs {
+		if _, ts := recordInfo(rec); !ts.Before(from) {
+			r.process(rec)
+		}
+	}
+
+	r.expire(time.Time{})
+	r.backfillPlaceholders()
+}
+
+// A checkpoint without the time it was created, which differs between runs.
+func comparableCheckpoint(t *testing.T, data []byte) string {
+	cp := map[string]any{}
+	require.NoError(t, json.Unmarshal(data, &cp))
+	delete(cp, "Created")
+
+	out, err := json.Marshal(cp)
+	require.NoError(t, err)
+
+	return string(out)
+}
+
+func TestCheckpointResume(t *testing.T) {
+	recs := checkpointRecords()
+	SortRecords(recs)
+
+	full := checkpointGenerator()
+	runFrom(full, recs, time.Time{})
+
+	checkpoints, err := full.Checkpoints()
+	require.NoError(t, err)
+	require.Contains(t, checkpoints, 2022)
+	require.Contains(t, checkpoints, 2023)
+
+	// The checkpoints hold the state carried across the year boundaries.
+	cp2022 := Checkpoint{}
+	require.NoError(t, json.Unmarshal(checkpoints[2022], &cp2022))
+	assert.Len(t, cp2022.Withdrawals, 1)
+	assert.Len(t, cp2022.Placeholders, 1)
+	assert.Equal(t, "0.2", cp2022.Placeholders[0].Unsettled.String())
+
+	cp2023 := Checkpoint{}
+	require.NoError(t, json.Unmarshal(checkpoints[2023], &cp2023))
+	assert.Empty(t, cp2023.Withdrawals)
+	assert.Len(t, cp2023.PendingDeposits, 1)
+	assert.NotEmpty(t, cp2023.Settlements)
+
+	accounts, err := json.Marshal(full.accounts)
+	require.NoError(t, err)
+
+	for _, year := range []int{2022, 2023} {
+		resumed := checkpointGenerator()
+		cp, err := resumed.Resume(checkpoints[year])
+		require.NoError(t, err)
+
+		runFrom(resumed, recs, cp.From)
+
+		resumedAccounts, err := json.Marshal(resumed.accounts)
+		require.NoError(t, err)
+		assert.Equal(t, string(accounts), string(resumedAccounts), "resuming from %d", year)
+
+		placeholders, err := json.Marshal(resumed.placeholders)
+		require.NoError(t, err)
+		fullPlaceholders, err := json.Marshal(full.placeholders)
+		require.NoError(t, err)
+		assert.Equal(t, string(fullPlaceholders), string(placeholders), "resuming from %d", year)
+
+		// Checkpoints of the following years are the same as well.
+		resumedCheckpoints, err := resumed.Checkpoints()
+		require.NoError(t, err)
+
+		for later, data := range resumedCheckpoints {
+			assert.Equal(t, comparableCheckpoint(t, checkpoints[later]), comparableCheckpoint(t, data), "checkpoint %d resuming from %d", later, year)
+		}
+	}
+}
+
+func TestCheckpointInputs(t *testing.T) {
+	recs := checkpointRecords()
+	SortRecords(recs)
+
+	full := checkpointGenerator()
+	runFrom(full, recs, time.Time{})
+
+	checkpoints, err := full.Checkpoints()
+	require.NoError(t, err)
+
+	withPrices := func(csv string) *prices.Prices {
+		p := prices.New()
+		require.NoError(t, p.Import("BTC", strings.NewReader(csv)))
+		return p
+	}
+
+	changes := map[string]func(r *Generator){
+		"transfer link":    func(r *Generator) { r.Links = TransferLinks{{Withdrawal: "w-b", Deposit: "d-b"}} },
+		"withdrawal class": func(r *Generator) { r.Classes = WithdrawalClasses{{Withdrawal: "w-c", Class: CLASS_GIFT}} },
+		"opening balance": func(r *Generator) {
+			r.OpeningBalances = OpeningBalances{{ID: "o1", Account: "A", Asset: "BTC", Units: "1"}}
+		},
+		"prices":               func(r *Generator) { r.Prices = withPrices("2021-06-01,30000") },
+		"placeholder fallback": func(r *Generator) { r.PlaceholderFallback = FALLBACK_MARKET },
+		"no negative balances": func(r *Generator) { r.NegativeBalances = false },
+		"dust threshold": func(r *Generator) {
+			r.DustThresholds = map[string]decimal.Decimal{"BTC": decimal.RequireFromString("0.0001")}
+		},
+		"own wallet addresses": func(r *Generator) {
+			r.AddressBook = NewAddressBook(map[string]string{"bc1qxy2kgdygjrsqtzq2n0yrf2493p83kkfjhx0wlh": "Ledger"})
+		},
+	}
+
+	for name, change := range changes {
+		t.Run(name, func(t *testing.T) {
+			resumed := checkpointGenerator()
+			change(resumed)
+
+			_, err := resumed.Resume(checkpoints[2022])
+			assert.Error(t, err)
+			assert.Empty(t, resumed.accounts)
+			assert.False(t, resumed.resumed)
+		})
+	}
+
+	t.Run("precision", func(t *testing.T) {
+		defer func(maxResidual int64) { global.Precision.MaxResidual = maxResidual }(global.Precision.MaxResidual)
+		global.Precision.MaxResidual = 100
+
+		_, err := checkpointGenerator().Resume(checkpoints[2022])
+		assert.Error(t, err)
+	})
+
+	t.Run("same inputs", func(t *testing.T) {
+		_, err := checkpointGenerator().Resume(checkpoints[2022])
+		assert.NoError(t, err)
+	})
+}
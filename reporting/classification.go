@@ -0,0 +1,108 @@
+package reporting
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/f-taxes/german_tax_report/fifo"
+	. "github.com/f-taxes/german_tax_report/global"
+	d "github.com/shopspring/decimal"
+)
+
+const (
+	CLASS_PAYMENT    = "payment"    // Assets were spent on goods or services. Taxable disposal at market value.
+	CLASS_GIFT       = "gift"       // Assets were given away. Not a taxable disposal.
+	CLASS_UNRESOLVED = "unresolved" // Nobody told us where the assets went.
+)
+
+// WithdrawalClass tells what happened to a withdrawal that went to a third party instead of one of our own accounts.
+type WithdrawalClass struct {
+	Withdrawal string `json:"withdrawal"` // TxID of the withdrawal.
+	Class      string `json:"class"`      // Either CLASS_PAYMENT or CLASS_GIFT.
+	ValueEur   string `json:"valueEur"`   // Market value in EUR of what was received in return. Only used for payments.
+}
+
+type WithdrawalClasses []WithdrawalClass
+
+// Get returns the classification of the withdrawal, if there is one.
+func (w WithdrawalClasses) Get(withdrawalID string) (WithdrawalClass, bool) {
+	for _, c := range w {
+		if c.Withdrawal == withdrawalID {
+			return c, true
+		}
+	}
+
+	return WithdrawalClass{}, false
+}
+
+// Set adds the classification or replaces an existing one for the same withdrawal.
+func (w WithdrawalClasses) Set(class WithdrawalClass) WithdrawalClasses {
+	return append(w.Remove(class.Withdrawal), class)
+}
+
+// Remove deletes the classification of the withdrawal, if there is one.
+func (w WithdrawalClasses) Remove(withdrawalID string) WithdrawalClasses {
+	out := WithdrawalClasses{}
+
+	for _, c := range w {
+		if c.Withdrawal != withdrawalID {
+			out = append(out, c)
+		}
+	}
+
+	return out
+}
+
+// Withdrawals that are still unmatched after all records are processed left our accounts for good.
+// Depending on their classification they are either a taxable disposal, a gift or reported as unresolved.
+func (r *Generator) classifyWithdrawals() {
+	for _, w := range r.recentWithdrawals {
+		if len(w.remaining) == 0 {
+			continue
+		}
+
+		class, ok := r.Classes.Get(w.RecID)
+
+		if !ok {
+			w.Classification = CLASS_UNRESOLVED
+			w.Error = fmt.Sprintf("Withdrawal was not matched with a deposit and is not classified. These lots left the account: %s.", describeLots(w.Asset, w.remaining))
+			continue
+		}
+
+		w.Classification = class.Class
+
+		switch class.Class {
+		case CLASS_GIFT:
+			w.Warning = "Withdrawal is classified as gift and not taxed."
+		case CLASS_PAYMENT:
+			valueEur := D(class.ValueEur)
+
+			if class.ValueEur == "" {
+				w.Error = "Withdrawal is classified as payment, but no market value was given."
+				continue
+			}
+
+			costEur := lotCostEur(w.remaining)
+
+			w.Result = &ConversionResult{
+				CostEur:     costEur,
+				ValueEur:    RoundEur(valueEur),
+				PnlEur:      RoundEur(valueEur.Sub(costEur)),
+				FeePayedEur: d.Zero,
+			}
+		default:
+			w.Classification = CLASS_UNRESOLVED
+			w.Error = fmt.Sprintf("Unknown classification %q. These lots left the account: %s.", class.Class, describeLots(w.Asset, w.remaining))
+		}
+	}
+}
+
+func describeLots(asset string, entries fifo.EntryList) string {
+	lots := []string{}
+
+	for _, e := range entries {
+		lots = append(lots, fmt.Sprintf("%s %s acquired %s at %s€", e.UnitsLeft, asset, e.Ts.Format("2006-01-02 15:04:05"), e.UnitCostEur))
+	}
+
+	return strings.Join(lots, ", ")
+}
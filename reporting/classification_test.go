@@ -0,0 +1,87 @@
+package reporting
+
+import (
+	"testing"
+	"time"
+
+	"github.com/f-taxes/german_tax_report/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+// Withdraw all of account A's BTC to a third party and finish the run with the given classifications.
+func classifiedWithdrawal(classes WithdrawalClasses) (*Generator, *Withdrawal) {
+	r := fundedGenerator(map[string]string{"BTC": "1"})
+	r.Classes = classes
+
+	runFrom(r, []*proto.Record{withdrawalRec("w1", 0, "A", "Shop", "BTC", "1")}, time.Time{})
+	r.classifyWithdrawals()
+
+	return r, withdrawal(r, "w1")
+}
+
+func TestClassifyWithdrawals(t *testing.T) {
+	t.Run("payment", func(t *testing.T) {
+		r, w := classifiedWithdrawal(WithdrawalClasses{{Withdrawal: "w1", Class: CLASS_PAYMENT, ValueEur: "1.5"}})
+
+		assert.Equal(t, CLASS_PAYMENT, w.Classification)
+		assert.Empty(t, w.Error)
+		if assert.NotNil(t, w.Result) {
+			assert.Equal(t, "1", w.Result.CostEur.String())
+			assert.Equal(t, "1.5", w.Result.ValueEur.String())
+			assert.Equal(t, "0.5", w.Result.PnlEur.String())
+		}
+
+		matches := r.Report().Matches
+		if assert.Len(t, matches, 1) {
+			assert.Equal(t, DISPOSAL_PAYMENT, matches[0].Kind)
+			assert.Equal(t, "0.5", matches[0].GainEur.String())
+		}
+	})
+
+	t.Run("payment without a market value", func(t *testing.T) {
+		_, w := classifiedWithdrawal(WithdrawalClasses{{Withdrawal: "w1", Class: CLASS_PAYMENT}})
+
+		assert.Equal(t, CLASS_PAYMENT, w.Classification)
+		assert.Contains(t, w.Error, "no market value")
+		assert.Nil(t, w.Result)
+	})
+
+	t.Run("gift", func(t *testing.T) {
+		r, w := classifiedWithdrawal(WithdrawalClasses{{Withdrawal: "w1", Class: CLASS_GIFT}})
+
+		assert.Equal(t, CLASS_GIFT, w.Classification)
+		assert.Empty(t, w.Error)
+		assert.Contains(t, w.Warning, "gift")
+		assert.Nil(t, w.Result)
+		assert.Empty(t, r.Report().Matches)
+	})
+
+	t.Run("not classified", func(t *testing.T) {
+		_, w := classifiedWithdrawal(nil)
+
+		assert.Equal(t, CLASS_UNRESOLVED, w.Classification)
+		assert.Contains(t, w.Error, "1 BTC acquired 2024-01-20 14:00:00 at 1€")
+	})
+
+	t.Run("unknown classification", func(t *testing.T) {
+		_, w := classifiedWithdrawal(WithdrawalClasses{{Withdrawal: "w1", Class: "lost"}})
+
+		assert.Equal(t, CLASS_UNRESOLVED, w.Classification)
+		assert.Contains(t, w.Error, `Unknown classification "lost"`)
+	})
+
+	t.Run("matched withdrawal", func(t *testing.T) {
+		r := fundedGenerator(map[string]string{"BTC": "1"})
+		r.Classes = WithdrawalClasses{{Withdrawal: "w1", Class: CLASS_GIFT}}
+
+		runFrom(r, []*proto.Record{
+			withdrawalRec("w1", 0, "A", "B", "BTC", "1"),
+			depositRec("d1", 2, "B", "BTC", "1"),
+		}, time.Time{})
+		r.classifyWithdrawals()
+
+		w := withdrawal(r, "w1")
+		assert.Empty(t, w.Classification)
+		assert.Empty(t, w.Error)
+	})
+}
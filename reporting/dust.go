@@ -0,0 +1,85 @@
+package reporting
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/f-taxes/german_tax_report/fifo"
+	. "github.com/f-taxes/german_tax_report/global"
+	d "github.com/shopspring/decimal"
+)
+
+// DustWriteOff removes units that are left over after a take but are too few to ever be sold.
+// The remaining cost basis of those units is booked as loss.
+type DustWriteOff struct {
+	RecID       string // ID of the record that left the dust behind.
+	Ts          time.Time
+	Type        string
+	Account     string
+	Asset       string
+	Amount      d.Decimal
+	Entries     fifo.EntryList
+	Result      ConversionResult
+	QueueBefore []fifo.Snapshot
+	QueueAfter  []fifo.Snapshot
+	Warning     string
+}
+
+type dustCandidate struct {
+	account string
+	asset   string
+}
+
+// Remember queues a take was made from, so they can be checked for dust once the record is processed.
+// Writing off right away would take units that later takes of the same record, like fees, still need.
+func (r *Ledger) markDustCandidate(account, asset string) {
+	if _, ok := r.DustThresholds[asset]; !ok {
+		return
+	}
+
+	for _, c := range r.dustCandidates {
+		if c.account == account && c.asset == asset {
+			return
+		}
+	}
+
+	r.dustCandidates = append(r.dustCandidates, dustCandidate{account: account, asset: asset})
+}
+
+// Write off everything left in the queues touched by the record, if it doesn't exceed the asset's dust threshold.
+func (r *Ledger) writeOffDust(recID string, ts time.Time) {
+	candidates := r.dustCandidates
+	r.dustCandidates = nil
+
+	for _, c := range candidates {
+		acc := r.accounts.Get(c.account)
+		before := acc.Snapshot(c.asset)
+		units := before.Asset().Entries.TotalUnitsLeft()
+
+		if !units.IsPositive() || units.GreaterThan(r.DustThresholds[c.asset]) {
+			continue
+		}
+
+		entries := acc.WriteOff(c.asset)
+		costEur := lotCostEur(entries)
+
+		r.Recs = append(r.Recs, &DustWriteOff{
+			RecID:   recID,
+			Ts:      ts,
+			Type:    "dust",
+			Account: c.account,
+			Asset:   c.asset,
+			Amount:  units,
+			Entries: entries,
+			Result: ConversionResult{
+				CostEur:     costEur,
+				ValueEur:    d.Zero,
+				PnlEur:      RoundEur(costEur.Neg()),
+				FeePayedEur: d.Zero,
+			},
+			QueueBefore: []fifo.Snapshot{before},
+			QueueAfter:  []fifo.Snapshot{acc.Snapshot(c.asset)},
+			Warning:     fmt.Sprintf("%s %s left in %s are below the dust threshold and were written off.", units, c.asset, c.account),
+		})
+	}
+}
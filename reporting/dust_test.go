@@ -0,0 +1,85 @@
+package reporting
+
+import (
+	"testing"
+	"time"
+
+	"github.com/f-taxes/german_tax_report/proto"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func dustWriteOffs(r *Generator) []*DustWriteOff {
+	out := []*DustWriteOff{}
+
+	for _, rec := range r.Recs {
+		if w, ok := rec.(*DustWriteOff); ok {
+			out = append(out, w)
+		}
+	}
+
+	return out
+}
+
+// Buy a BTC at 20000€ and sell all but the given units, with the given dust thresholds.
+func leaveBehind(thresholds map[string]string, left string) *Generator {
+	units := decimal.RequireFromString
+
+	r := NewGenerator()
+	for asset, threshold := range thresholds {
+		r.DustThresholds[asset] = units(threshold)
+	}
+
+	r.process(propertyTrade("buy", transferStart, "A", proto.TxAction_BUY, units("1"), units("20000")))
+	r.process(propertyTrade("sell", transferStart.Add(time.Hour), "A", proto.TxAction_SELL, units("1").Sub(units(left)), units("30000")))
+
+	return r
+}
+
+func TestDustWriteOff(t *testing.T) {
+	t.Run("left over units below the threshold", func(t *testing.T) {
+		r := leaveBehind(map[string]string{"BTC": "0.0001"}, "0.00001")
+
+		writeOffs := dustWriteOffs(r)
+		if assert.Len(t, writeOffs, 1) {
+			w := writeOffs[0]
+			assert.Equal(t, "sell", w.RecID)
+			assert.Equal(t, "0.00001", w.Amount.String())
+			assert.Equal(t, "0.2", w.Result.CostEur.String())
+			assert.Equal(t, "-0.2", w.Result.PnlEur.String())
+			assert.Equal(t, "0.00001", w.QueueBefore[0].Asset().Total)
+			assert.Equal(t, "0", w.QueueAfter[0].Asset().Total)
+		}
+
+		// The write-off follows the record that left the dust behind.
+		assert.IsType(t, &DustWriteOff{}, r.Recs[len(r.Recs)-1])
+		assert.False(t, r.accounts.Get("A").HasUnits("BTC"))
+
+		matches := r.Report().Matches
+		assert.Equal(t, DISPOSAL_DUST, matches[len(matches)-1].Kind)
+		assert.Equal(t, "-0.2", matches[len(matches)-1].GainEur.String())
+	})
+
+	t.Run("left over units above the threshold", func(t *testing.T) {
+		r := leaveBehind(map[string]string{"BTC": "0.0001"}, "0.001")
+
+		assert.Empty(t, dustWriteOffs(r))
+		assert.Equal(t, "0.001", r.accounts.Get("A").Read("BTC").Total)
+	})
+
+	t.Run("asset without a threshold", func(t *testing.T) {
+		r := leaveBehind(map[string]string{"ETH": "0.0001"}, "0.00001")
+
+		assert.Empty(t, dustWriteOffs(r))
+		assert.Equal(t, "0.00001", r.accounts.Get("A").Read("BTC").Total)
+	})
+
+	t.Run("acquisitions are never written off", func(t *testing.T) {
+		r := NewGenerator()
+		r.DustThresholds["BTC"] = decimal.RequireFromString("0.0001")
+		r.process(propertyTrade("buy", transferStart, "A", proto.TxAction_BUY, decimal.RequireFromString("0.00001"), decimal.RequireFromString("20000")))
+
+		assert.Empty(t, dustWriteOffs(r))
+		assert.Equal(t, "0.00001", r.accounts.Get("A").Read("BTC").Total)
+	})
+}
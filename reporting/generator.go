@@ -6,56 +6,78 @@ import (
 	"sync"
 	"time"
 
-	"github.com/f-taxes/german_tax_report/fifo"
-	"github.com/f-taxes/german_tax_report/global"
 	. "github.com/f-taxes/german_tax_report/global"
 	g "github.com/f-taxes/german_tax_report/grpc_client"
 	"github.com/f-taxes/german_tax_report/proto"
 	"github.com/kataras/golog"
-	d "github.com/shopspring/decimal"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type Generator struct {
-	Recs              []any
-	accounts          AccountFifo
-	recentWithdrawals []*Withdrawal
-	marginShortTrades map[string]bool
-	l                 sync.Mutex
+	*Ledger
+	Handlers        RecordHandlers    // Book the records, the first handler responsible for a record wins.
+	Classes         WithdrawalClasses // What happened to withdrawals that went to third parties.
+	OpeningBalances OpeningBalances   // Holdings from before the first record.
+	checkpoints     map[int][]byte    // Serialized checkpoints taken at the start of each year, keyed by year.
+	checkpointErr   error
+	lastYear        int  // Year of the last processed record.
+	resumed         bool // State was restored from a checkpoint.
+	progress        Progress
+	l               sync.Mutex // Guards the progress, which is read while the generator runs.
 }
 
 func NewGenerator() *Generator {
 	return &Generator{
-		Recs:              []any{},
-		accounts:          AccountFifo{},
-		recentWithdrawals: []*Withdrawal{},
-		marginShortTrades: map[string]bool{},
+		Ledger:      NewLedger(),
+		Handlers:    DefaultHandlers(),
+		checkpoints: map[int][]byte{},
 	}
 }
 
-func (r *Generator) Start(from, to time.Time) error {
+// Register a handler for a new kind of record. It takes precedence over the handlers registered before,
+// so it may also take over records of a kind that is already handled.
+func (r *Generator) Register(h RecordHandler) {
+	r.Handlers = append(RecordHandlers{h}, r.Handlers...)
+}
+
+// Streams the records between from and to and processes them. Returns early if streaming fails or the context
+// is cancelled, the generator's state is incomplete then.
+func (r *Generator) Start(ctx context.Context, from, to time.Time) (err error) {
 	recordChan := make(chan *proto.Record)
 	doneChan := make(chan struct{})
 
+	r.updateProgress(func(p *Progress) {
+		*p = Progress{JobID: fmt.Sprintf("%s-%d", Plugin.ID, time.Now().UnixNano()), Phase: PHASE_STREAMING, From: from, To: to}
+	})
+
+	defer func() {
+		r.updateProgress(func(p *Progress) {
+			p.Phase = PHASE_DONE
+
+			if err != nil {
+				p.Error = err.Error()
+			}
+		})
+	}()
+
+	// The stream's order isn't reliable for records with the same timestamp, so all records are collected and sorted first.
+	recs := []*proto.Record{}
+
 	go func() {
 		for rec := range recordChan {
-			if rec.Transfer != nil {
-				if c := r.processTransfer(rec.Transfer); c != nil {
-					r.Recs = append(r.Recs, c)
-				}
-			}
+			recs = append(recs, rec)
 
-			if rec.Trade != nil {
-				if c := r.processTrade(rec.Trade); c != nil {
-					r.Recs = append(r.Recs, c)
-				}
-			}
+			_, ts := recordInfo(rec)
+			r.updateProgress(func(p *Progress) {
+				p.Streamed++
+				p.Current = ts
+			})
 		}
 
 		close(doneChan)
 	}()
 
-	err := g.GrpcClient.StreamRecords(context.Background(), &proto.StreamRecordsJob{
+	err = g.GrpcClient.StreamRecords(ctx, &proto.StreamRecordsJob{
 		Plugin:        Plugin.ID,
 		PluginVersion: Plugin.Version,
 		From:          timestamppb.New(from),
@@ -65,362 +87,63 @@ func (r *Generator) Start(from, to time.Time) error {
 	close(recordChan)
 	<-doneChan
 
-	return err
-}
-
-// func (r *Generator) process(recordChan chan *proto.Record) {
-// 	for rec := range recordChan {
-// 		if rec.Transfer != nil {
-// 			c := r.processTransfer(rec.Transfer)
-// 			r.Recs = append(r.Recs, c)
-// 		}
-
-// 		if rec.Trade != nil {
-// 			c := r.processTrade(rec.Trade)
-// 			r.Recs = append(r.Recs, c)
-// 		}
-// 	}
-// }
-
-func (r *Generator) processTransfer(transfer *proto.Transfer) (w *Withdrawal) {
-	if transfer.Action == proto.TransferAction_DEPOSIT {
-		deposit := &Deposit{
-			Ts:      transfer.Ts.AsTime(),
-			Type:    "deposit",
-			Asset:   transfer.Asset,
-			Amount:  D(transfer.Amount),
-			Account: transfer.Account,
-			Source:  transfer.Source,
-			Fee:     D(transfer.Fee),
-			FeeEur:  D(transfer.FeeC),
-		}
-
-		defer func() {
-			deposit.QueueAfter = append(deposit.QueueAfter, r.accounts.Get(deposit.Account).Read(deposit.Asset))
-		}()
-
-		deposit.QueueBefore = append(deposit.QueueBefore, r.accounts.Get(deposit.Account).Read(deposit.Asset))
-
-		var matching *Withdrawal
-
-		for i, w := range r.recentWithdrawals {
-			if w.Entries.TotalUnitsLeft().IsZero() {
-				fmt.Printf("%+v\n", "now")
-			}
-			if w.Destination == transfer.Account && w.Ts.Sub(transfer.Ts.AsTime()).Abs() < time.Minute*15 && global.PercentageDelta(D(transfer.Amount), w.Entries.TotalUnitsLeft()).LessThan(D("10")) {
-				matching = r.recentWithdrawals[i]
-				r.recentWithdrawals = global.RemoveElementUnordered(r.recentWithdrawals, i)
-				break
-			}
-		}
-
-		deductFees := func() {
-			if D(transfer.Fee).GreaterThan(d.Zero) {
-				feeAssets, err := r.accounts.Get(transfer.Account).Take(transfer.FeeCurrency, D(transfer.Fee), transfer.FeeDecimals)
-				if err != nil {
-					golog.Errorf("Failed to withdraw %s %s from %s: %v", transfer.Amount, transfer.Asset, transfer.Account, err)
-				}
-
-				deposit.Entries = append(deposit.Entries, feeAssets.Entries...)
-			}
-		}
-
-		if matching != nil {
-			deposit.Entries = matching.Entries.Copy()
-			r.Recs = append(r.Recs, deposit)
-
-			for _, e := range deposit.Entries {
-				r.accounts.Get(transfer.Account).Add(transfer.Asset, e.Copy())
-			}
-
-			deductFees()
-		}
-
-		if matching == nil {
-			if global.IsFiatCurrency(transfer.Asset) {
-				entry := fifo.Entry{
-					Units:       D(transfer.Amount, d.Zero),
-					UnitsLeft:   D(transfer.Amount, d.Zero),
-					UnitCostEur: D("1"),
-					Ts:          transfer.Ts.AsTime(),
-				}
-
-				deposit.Entries = append(deposit.Entries, entry)
-				deposit.Warning = "No records about how this deposit came do be. Assuming bank account transfer."
-				r.Recs = append(r.Recs, deposit)
-
-				r.accounts.Get(transfer.Account).Add(transfer.Asset, entry)
-
-				deductFees()
-			} else {
-				deposit.Error = "No prior withdrawal found to explain how this deposit was possible."
-				r.Recs = append(r.Recs, deposit)
-			}
-		}
-	}
-
-	if transfer.Action == proto.TransferAction_WITHDRAWAL {
-		w = &Withdrawal{
-			RecID:       transfer.TxID,
-			Ts:          transfer.Ts.AsTime(),
-			Type:        "withdrawal",
-			Account:     transfer.Account,
-			Asset:       transfer.Asset,
-			Amount:      D(transfer.Amount),
-			Destination: transfer.Destination,
-			Fee:         D(transfer.Fee),
-			FeeEur:      D(transfer.FeeC),
-		}
-
-		defer func() {
-			w.QueueAfter = append(w.QueueAfter, r.accounts.Get(w.Account).Read(w.Asset))
-		}()
-
-		w.QueueBefore = append(w.QueueBefore, r.accounts.Get(w.Account).Read(w.Asset))
-
-		asset, err := r.accounts.Get(transfer.Account).Take(transfer.Asset, D(transfer.Amount), transfer.AssetDecimals)
-		if err != nil {
-			golog.Errorf("Failed to withdraw %s %s from %s: %v", transfer.Amount, transfer.Asset, transfer.Account, err)
-		}
-
-		if D(transfer.Fee).GreaterThan(d.Zero) {
-			feeAssets, err := r.accounts.Get(transfer.Account).Take(transfer.FeeCurrency, D(transfer.Fee), transfer.FeeDecimals)
-			if err != nil {
-				golog.Errorf("Failed to withdraw %s %s from %s: %v", transfer.Amount, transfer.Asset, transfer.Account, err)
-			}
-
-			asset.Entries = append(asset.Entries, feeAssets.Entries...)
-		}
-
-		w.Entries = asset.Entries
-
-		r.recentWithdrawals = append(r.recentWithdrawals, w)
-
-		return
-
-		// golog.Infof("TRANSFER %s: Take %s %s (withdrawal)", transfer.Account, transfer.Amount, transfer.Asset)
-
-		// desc.Add(transfer.Account, convert{Asset: transfer.Asset, })
-		// if transfer.Destination != "" {
-		// 	for i := range entries {
-		// 		r.accounts.Get(transfer.Destination).Add(transfer.Asset, entries[i])
-		// 	}
-		// }
-		// r.desc.Add(transfer.Account, move{Asset: transfer.Asset, Entries: entries, Ts: transfer.Ts.AsTime(), Source: transfer.Source, Destination: transfer.Destination})
-	}
-
-	return
-}
-
-func (r *Generator) processMarginTrade(trade *proto.Trade) (c *Conversion) {
-	c = r.TradeToConversion(trade)
-	key := fmt.Sprintf("%s_%s", c.Account, trade.Ticker)
-
-	acc := r.accounts.Get(c.Account, "margin")
-
-	defer func() {
-		if r.accounts.Get(c.Account).HasUnits(c.To) {
-			c.QueueAfter = append(c.QueueAfter, acc.Read(c.To))
-		}
-
-		if r.accounts.Get(c.Account).HasUnits(c.From) {
-			c.QueueAfter = append(c.QueueAfter, acc.Read(c.From))
-		}
-
-		r.Recs = append(r.Recs, c)
-	}()
-
-	if r.accounts.Get(c.Account).HasUnits(c.To) {
-		c.QueueBefore = append(c.QueueBefore, acc.Read(c.To))
+	if err != nil {
+		return fmt.Errorf("failed to stream records: %w", err)
 	}
 
-	if r.accounts.Get(c.Account).HasUnits(c.From) {
-		c.QueueBefore = append(c.QueueBefore, acc.Read(c.From))
+	// Opening balances are part of the checkpoint already.
+	if !r.resumed {
+		r.addOpeningBalances()
 	}
 
-	if acc.HasUnits(c.To) {
-		pastEntries := fifo.EntryList{}
-		isShort := r.marginShortTrades[key]
-
-		if trade.Action == proto.TxAction_BUY {
-			if isShort {
-				pastEntries, err := acc.Take(c.To, c.ToAmount, c.ToDecimals)
-				c.FromEntries = []fifo.Asset{pastEntries}
-
-				if err != nil {
-					golog.Errorf("Failed to take units for %s out of fifo queue (ID=%s, TS=%s, MARGIN=%v): %v", c.From, trade.TxID, trade.Ts.AsTime(), trade.Props.IsMarginTrade, err)
-					return
-				}
-			} else {
-				acc.Add(c.To, fifo.NewEntry(c.ToAmount, c.FromAmountEur, c.FeeEur, c.Ts))
-			}
-		}
-
-		if trade.Action == proto.TxAction_SELL {
-			if isShort {
-				acc.Add(c.To, fifo.NewEntry(c.ToAmount, c.FromAmountEur, c.FeeEur, c.Ts))
-			} else {
-				pastEntries, err := acc.Take(c.From, c.FromAmount, c.FromDecimals)
-				c.FromEntries = []fifo.Asset{pastEntries}
-
-				if err != nil {
-					golog.Errorf("Failed to take units for %s out of fifo queue (ID=%s, TS=%s, MARGIN=%v): %v", c.From, trade.TxID, trade.Ts.AsTime(), trade.Props.IsMarginTrade, err)
-					return
-				}
-			}
-		}
-
-		totalCostC := d.Zero
-		// totalCost := d.Zero
-
-		for _, e := range pastEntries {
-			totalCostC = e.UnitCostEur.Mul(e.UnitsLeft).Add(e.UnitFeeCostEur.Mul(e.UnitsLeft))
-			// totalCost = e.UnitCost.Mul(e.UnitsLeft).Add(e.UnitFeeCost.Mul(e.UnitsLeft))
-		}
-
-		c.Result = ConversionResult{
-			CostEur:  totalCostC,
-			ValueEur: c.FromAmountEur.Sub(c.FeeEur),
-			// Pnl: c.FromAmount.Sub(c.Fee).Sub(totalCost),
-			PnlEur:      c.FromAmountEur.Sub(c.FeeEur).Sub(totalCostC),
-			FeePayedEur: c.FeeEur,
-		}
-	} else {
-		if trade.Action == proto.TxAction_SELL {
-			acc.Add(c.From, fifo.NewEntry(c.FromAmount, c.ToAmountEur, c.FeeEur, c.Ts))
-			r.marginShortTrades[key] = true
-		} else {
-			acc.Add(c.To, fifo.NewEntry(c.ToAmount, c.FromAmountEur, c.FeeEur, c.Ts))
-		}
-	}
+	SortRecords(recs)
 
-	// Remove fee from fifo queue.
-	if !c.Fee.IsZero() {
-		_, err := r.accounts.Get(c.Account).Take(c.FeeCurrency, c.Fee, c.FeeDecimals)
+	r.updateProgress(func(p *Progress) {
+		p.Phase = PHASE_MATCHING
+		p.Current = from
+	})
 
-		if err != nil {
-			golog.Errorf("Failed to take units for %s out of fifo queue to pay fees (ID=%s, TS=%s): %v", c.FeeCurrency, trade.TxID, trade.Ts.AsTime(), err)
+	for _, rec := range recs {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-	}
 
-	if !c.QuoteFee.IsZero() {
-		_, err := r.accounts.Get(c.Account).Take(c.QuoteFeeCurrency, c.QuoteFee, c.QuoteFeeDecimals)
+		r.process(rec)
 
-		if err != nil {
-			// fmt.Printf("%s\n", r.accounts.Get(trade.Account).Read("EUR").Entries.Print())
-			golog.Errorf("Failed to take units for %s out of fifo queue to pay fees (ID=%s, TS=%s): %v", c.QuoteFeeCurrency, trade.TxID, trade.Ts.AsTime(), err)
-		}
+		_, ts := recordInfo(rec)
+		r.updateProgress(func(p *Progress) {
+			p.Processed++
+			p.Current = ts
+		})
 	}
 
-	// if c.Result.Pnl != nil {
+	r.updateProgress(func(p *Progress) {
+		p.Phase = PHASE_SUMMARIZING
+	})
 
-	// }
+	r.expire(time.Time{})
+	r.backfillPlaceholders()
+	r.classifyWithdrawals()
 
-	return
+	return nil
 }
 
-func (r *Generator) processTrade(trade *proto.Trade) (c *Conversion) {
-	if trade.Props.IsMarginTrade {
-		return r.processMarginTrade(trade)
-	}
-
-	c = r.TradeToConversion(trade)
-
-	acc := r.accounts.Get(c.Account)
-
-	defer func() {
-		if acc.HasUnits(c.To) {
-			c.QueueAfter = append(c.QueueAfter, acc.Read(c.To))
-		}
-
-		if acc.HasUnits(c.From) {
-			c.QueueAfter = append(c.QueueAfter, acc.Read(c.From))
-		}
-	}()
-
-	if acc.HasUnits(c.To) {
-		c.QueueBefore = append(c.QueueBefore, acc.Read(c.To))
-	}
-
-	if acc.HasUnits(c.From) {
-		c.QueueBefore = append(c.QueueBefore, acc.Read(c.From))
-	}
-
-	acc.Add(c.To, fifo.NewEntry(c.ToAmount, c.FromAmountEur, c.FeeEur, c.Ts))
-	assetExtracted, err := acc.Take(c.From, c.FromAmount, c.FromDecimals)
-
-	c.FromEntries = []fifo.Asset{assetExtracted}
-
-	if err != nil {
-		ferr := err.(fifo.FifoError)
-		c.Error = fmt.Sprintf("Not enough %s available in FIFO queue. Trying to take %s but queue only holds %s (missing %s).", c.From, ferr.RequiredAmount, D(ferr.RequiredAmount).Sub(D(ferr.MissingAmount)).String(), ferr.MissingAmount)
-		golog.Errorf("Failed to take units for %s out of fifo queue (ID=%s, TS=%s, MARGIN=%v): %v", c.From, trade.TxID, trade.Ts.AsTime(), trade.Props.IsMarginTrade, err)
-	}
-
-	// Remove fee from fifo queue.
-	if !c.Fee.IsZero() {
-		extractedEntries, err := acc.Take(c.FeeCurrency, c.Fee, c.FeeDecimals)
-
-		if err != nil {
-			golog.Errorf("Failed to take units for %s out of fifo queue to pay fees (ID=%s, TS=%s): %v", c.FeeCurrency, trade.TxID, trade.Ts.AsTime(), err)
-		}
-
-		c.FromEntries = append(c.FromEntries, extractedEntries)
-	}
-
-	if !c.QuoteFee.IsZero() {
-		if trade.TxID == "TPJR2V-X7L54-Z6665S" {
-			fmt.Printf("%+v\n", "now")
-			// fmt.Printf("%s\n", r.accounts.Get(trade.Account).Read("EUR").Entries.Print())
-		}
-
-		fmt.Printf("%+v\n", acc.Read(c.QuoteFeeCurrency).Entries.Print())
-		extractedEntries, err := acc.Take(c.QuoteFeeCurrency, c.QuoteFee, c.QuoteFeeDecimals)
-		fmt.Printf("%+v\n", acc.Read(c.QuoteFeeCurrency).Entries.Print())
-
-		if err != nil {
-			// fmt.Printf("%s\n", r.accounts.Get(trade.Account).Read("EUR").Entries.Print())
-			golog.Errorf("Failed to take units for %s out of fifo queue to pay fees (ID=%s, TS=%s): %v", c.QuoteFeeCurrency, trade.TxID, trade.Ts.AsTime(), err)
-		}
-
-		c.FromEntries = append(c.FromEntries, extractedEntries)
-	}
-
-	totalCostC := d.Zero
-
-	for _, e := range assetExtracted.Entries {
-		totalCostC = totalCostC.Add(e.UnitCostEur.Mul(e.UnitsLeft).Round(4).Add(e.UnitFeeCostEur.Mul(e.UnitsLeft).Round(4))).Round(4)
+func (r *Generator) process(rec *proto.Record) {
+	h := r.Handlers.For(rec)
+	if h == nil {
+		golog.Warnf("No handler for record %v", rec)
+		return
 	}
 
-	// fmt.Printf("total cost: %s €\n", totalCostC)
-	// feeC := c.FeeEur
-	// feeC := D(trade.FeeC)
-	// fmt.Printf("selling value: %s €\n", c.FromAmountEur.Sub(c.FeeEur))
+	txID, ts := recordInfo(rec)
 
-	// fmt.Printf("pnl: %s €\n", c.FromAmountEur.Sub(c.FeeEur).Sub(totalCostC))
-	// fmt.Printf("pnl: %s €\n", D(trade.ValueC).Sub(feeC).Sub(totalCostC))
+	r.now = ts
+	r.checkpointAt(ts)
+	r.expire(ts)
 
-	c.Result = ConversionResult{
-		CostEur:     totalCostC,
-		ValueEur:    c.FromAmountEur.Sub(c.FeeEur).Round(4),
-		PnlEur:      c.FromAmountEur.Sub(c.FeeEur).Sub(totalCostC).Round(4),
-		FeePayedEur: c.FeeEur,
+	if c := h.Handle(r.Ledger, rec); c != nil {
+		r.Recs = append(r.Recs, c)
 	}
 
-	return
-
-	// fmt.Printf("%s\n", r.accounts.Get(trade.Account).Read("EUR").Entries.Print())
-
-	// r.desc.Add(c.Account, convert{Asset: c.To, Quote: c.From, Entries: pastEntries, Ts: c.Ts, Pnl: D(trade.ValueC).Sub(c.FeeEur).Sub(totalCostC).String()})
-	// fifoAssetMap := r.accounts.Get(tx.Account).Get(tx.Asset)
-
-	// if fifoAssetMap.BaseDirectionInverted == BASE_DIR_NONE {
-	// 	fifoAssetMap.BaseDirectionInverted = baseDirFromTxAction(tx.Action)
-	// }
-
-	// if baseDirFromTxAction(tx.Action) == fifoAssetMap.BaseDirectionInverted {
-	// 	fifoAssetMap.Queue.Add(fifo.NewFifoRecord(StrToDecimal(tx.Amount), StrToDecimal(tx.Price), StrToDecimal(tx.Fee)))
-	// } else {
-	// 	fifoAssetMap.Queue.Take(fifo.NewFifoRecord(StrToDecimal(tx.Amount), StrToDecimal(tx.Price), StrToDecimal(tx.Fee)))
-	// }
+	r.writeOffDust(txID, ts)
 }
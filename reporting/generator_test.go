@@ -70,22 +70,22 @@ func TestSpot(t *testing.T) {
 
 	g := NewGenerator()
 
-	g.processTransfer(&proto.Transfer{TxID: "1", Ts: toTime("2024-01-20T15:00:00Z"), Account: "Test1", Destination: "Test1", Asset: "EUR", Amount: "5000", Fee: "0", FeeC: "0", FeePriceC: "0", Action: proto.TransferAction_DEPOSIT})
+	g.processDeposit(&proto.Transfer{TxID: "1", Ts: toTime("2024-01-20T15:00:00Z"), Account: "Test1", Destination: "Test1", Asset: "EUR", Amount: "5000", Fee: "0", FeeC: "0", FeePriceC: "0", Action: proto.TransferAction_DEPOSIT})
 	assertEntry(g.accounts.Get("Test1").Read("EUR").Entries[0], ee{Units: "5000", UnitCostEur: "1", FeeEur: "0"})
 
-	g.processTrade(&proto.Trade{TxID: "2", Ts: toTime("2024-01-20T15:10:00Z"), Account: "Test1", Asset: "EUR", Quote: "USD", Amount: "5000", Price: "0.8", PriceC: "1.25", QuotePriceC: "1.25", Value: "4000", ValueC: "5000", Fee: "2", FeeC: "2.5", FeePriceC: "1.25", FeeCurrency: "USD", Props: &proto.Props{}, Action: proto.TxAction_SELL})
+	g.processTrade(&proto.Trade{TxID: "2", Ts: toTime("2024-01-20T15:10:00Z"), Account: "Test1", Asset: "EUR", Quote: "USD", Amount: "5000", Price: "0.8", PriceC: "1.25", QuotePriceC: "1.25", Value: "4000", ValueC: "5000", Fee: &proto.Cost{Currency: "USD", Amount: "2", AmountC: "2.5", PriceC: "1.25"}, QuoteFee: &proto.Cost{}, Props: &proto.Props{}, Action: proto.TxAction_SELL})
 
 	// Expect 3200$, 2.5€ fee
 	assertEntry(g.accounts.Get("Test1").Read("USD").Entries[0], ee{UnitsLeft: "3998", UnitCostEur: "1.25", FeeEur: "2.5"})
 
 	// Should have left 790$ after exchanging 3200$ for 10 BTC and paying a 8$ fee.
-	g.processTrade(&proto.Trade{TxID: "3", Ts: toTime("2024-01-20T15:20:00Z"), Account: "Test1", Asset: "BTC", Quote: "USD", Amount: "10", Price: "320", PriceC: "300", Value: "3200", ValueC: "3000", Fee: "8", FeeC: "10", FeePriceC: "0.8", FeeCurrency: "USD", Props: &proto.Props{}, Action: proto.TxAction_BUY})
+	g.processTrade(&proto.Trade{TxID: "3", Ts: toTime("2024-01-20T15:20:00Z"), Account: "Test1", Asset: "BTC", Quote: "USD", Amount: "10", Price: "320", PriceC: "300", Value: "3200", ValueC: "3000", Fee: &proto.Cost{Currency: "USD", Amount: "8", AmountC: "10", PriceC: "0.8"}, QuoteFee: &proto.Cost{}, Props: &proto.Props{}, Action: proto.TxAction_BUY})
 	assertEntry(g.accounts.Get("Test1").Read("USD").Entries[0], ee{UnitsLeft: "790", UnitCostEur: "1.25", FeeEur: "2.5"})
 
 	// Should own 10 BTC worth 300€ each.
 	assertEntry(g.accounts.Get("Test1").Read("BTC").Entries[0], ee{UnitsLeft: "10", UnitCostEur: "300", FeeEur: "10"})
 
-	g.processTrade(&proto.Trade{TxID: "4", Ts: toTime("2024-01-20T15:30:00Z"), Account: "Test1", Asset: "ETH", Quote: "BTC", Amount: "40", Price: "0.05", PriceC: "20", Value: "2", ValueC: "800", Fee: "0.02", FeeC: "8", FeePriceC: "400", FeeCurrency: "BTC", Props: &proto.Props{}, Action: proto.TxAction_BUY})
+	g.processTrade(&proto.Trade{TxID: "4", Ts: toTime("2024-01-20T15:30:00Z"), Account: "Test1", Asset: "ETH", Quote: "BTC", Amount: "40", Price: "0.05", PriceC: "20", Value: "2", ValueC: "800", Fee: &proto.Cost{Currency: "BTC", Amount: "0.02", AmountC: "8", PriceC: "400"}, QuoteFee: &proto.Cost{}, Props: &proto.Props{}, Action: proto.TxAction_BUY})
 	// assertResult(conv.Result, er{Pnl: "190", Fee: "8"})
 	// fmt.Printf("%+v\n", conv)
 
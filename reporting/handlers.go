@@ -0,0 +1,50 @@
+package reporting
+
+import (
+	"time"
+
+	"github.com/f-taxes/german_tax_report/proto"
+)
+
+// RecordHandler books one kind of record into the ledger. Handlers keep no state of their own, everything
+// they book goes into the ledger, so each of them can be run against a fresh ledger in isolation.
+type RecordHandler interface {
+	// Whether the handler is responsible for the record.
+	Handles(rec *proto.Record) bool
+	// Books the record. Returns what to add to the report, or nil if there is nothing or the handler added it itself.
+	Handle(l *Ledger, rec *proto.Record) any
+}
+
+type RecordHandlers []RecordHandler
+
+func DefaultHandlers() RecordHandlers {
+	return RecordHandlers{
+		tradeHandler{},
+		marginTradeHandler{},
+		depositHandler{},
+		withdrawalHandler{},
+	}
+}
+
+// The first handler responsible for the record, or nil if there is none.
+func (h RecordHandlers) For(rec *proto.Record) RecordHandler {
+	for _, handler := range h {
+		if handler.Handles(rec) {
+			return handler
+		}
+	}
+
+	return nil
+}
+
+// ID and time of a record, whatever its kind.
+func recordInfo(rec *proto.Record) (string, time.Time) {
+	switch {
+	case rec.Trade != nil:
+		return rec.Trade.TxID, rec.Trade.Ts.AsTime()
+	case rec.Transfer != nil:
+		return rec.Transfer.TxID, rec.Transfer.Ts.AsTime()
+	}
+
+	return "", time.Time{}
+}
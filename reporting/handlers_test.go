@@ -0,0 +1,59 @@
+package reporting
+
+import (
+	"testing"
+	"time"
+
+	"github.com/f-taxes/german_tax_report/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type incomeHandler struct{}
+
+func (incomeHandler) Handles(rec *proto.Record) bool {
+	return rec.Transfer != nil && rec.Transfer.Comment == "staking"
+}
+
+func (incomeHandler) Handle(l *Ledger, rec *proto.Record) any {
+	return "income"
+}
+
+func TestHandlers(t *testing.T) {
+	ts := time.Date(2024, time.January, 20, 15, 0, 0, 0, time.UTC)
+	deposit := &proto.Record{Transfer: &proto.Transfer{TxID: "1", Ts: timestamppb.New(ts), Account: "Test1", Asset: "EUR", Amount: "5000", Action: proto.TransferAction_DEPOSIT}}
+	buy := &proto.Record{Trade: &proto.Trade{
+		TxID: "2", Ts: timestamppb.New(ts.Add(time.Minute)), Account: "Test1", Ticker: "BTC/EUR", Asset: "BTC", Quote: "EUR", Action: proto.TxAction_BUY,
+		Amount: "0.1", Price: "40000", PriceC: "40000", QuotePriceC: "1", Value: "4000", ValueC: "4000", AssetDecimals: 8, QuoteDecimals: 2,
+		Fee: &proto.Cost{}, QuoteFee: &proto.Cost{}, Props: &proto.Props{},
+	}}
+
+	// Each handler books into the ledger it is given, without a generator around it.
+	l := NewLedger()
+	assert.Nil(t, depositHandler{}.Handle(l, deposit))
+	assert.Len(t, l.Recs, 1)
+
+	c, ok := tradeHandler{}.Handle(l, buy).(*Conversion)
+	assert.True(t, ok)
+	assert.Empty(t, c.Error)
+	assert.Equal(t, "0.1", l.accounts.Get("Test1").Read("BTC").Total)
+	assert.Equal(t, "1000", l.accounts.Get("Test1").Read("EUR").Total)
+
+	// Each kind of record has exactly one default handler.
+	handlers := DefaultHandlers()
+	assert.Equal(t, depositHandler{}, handlers.For(deposit))
+	assert.Equal(t, tradeHandler{}, handlers.For(buy))
+
+	buy.Trade.Props.IsMarginTrade = true
+	assert.Equal(t, marginTradeHandler{}, handlers.For(buy))
+	assert.Nil(t, handlers.For(&proto.Record{}))
+
+	// Registered handlers take precedence over the ones before them.
+	r := NewGenerator()
+	r.Register(incomeHandler{})
+	deposit.Transfer.Comment = "staking"
+	r.process(deposit)
+
+	assert.Equal(t, []any{"income"}, r.Recs)
+	assert.False(t, r.accounts.Get("Test1").HasUnits("EUR"))
+}
@@ -0,0 +1,103 @@
+package reporting
+
+import (
+	"time"
+
+	"github.com/f-taxes/german_tax_report/fifo"
+	. "github.com/f-taxes/german_tax_report/global"
+	"github.com/f-taxes/german_tax_report/prices"
+	"github.com/f-taxes/german_tax_report/rates"
+	d "github.com/shopspring/decimal"
+)
+
+// Ledger is the state record handlers share: the fifo queues of all accounts, the records of the report and
+// whatever is needed to match records with each other.
+type Ledger struct {
+	Recs                []any
+	Links               TransferLinks        // Manual overrides for matching withdrawals with deposits.
+	AddressBook         AddressBook          // Addresses of our own wallets.
+	FxRates             *rates.Rates         // EUR reference rates to value fiat currencies.
+	Prices              *prices.Prices       // Local daily EUR prices for values missing in the records.
+	DustThresholds      map[string]d.Decimal // Holdings of an asset at or below its threshold are written off after a take.
+	NegativeBalances    bool                 // Let takes exceed the holdings and settle the shortfall with later acquisitions.
+	PlaceholderFallback string               // Cost basis of shortfalls that are never settled. One of the FALLBACK_* values.
+	accounts            AccountFifo
+	recentWithdrawals   []*Withdrawal
+	pendingDeposits     []*pendingDeposit // Deposits waiting for a withdrawal with a later timestamp.
+	marginShortTrades   map[string]bool
+	residuals           []Residual // Rounding residuals written off by takes from the fifo queues.
+	dustCandidates      []dustCandidate
+	placeholders        []*placeholder
+	settlements         map[string]fifo.EntryList // Lots that settled a placeholder, keyed by placeholder ID.
+	now                 time.Time                 // Time of the record being processed.
+}
+
+func NewLedger() *Ledger {
+	return &Ledger{
+		Recs:                []any{},
+		accounts:            AccountFifo{},
+		recentWithdrawals:   []*Withdrawal{},
+		pendingDeposits:     []*pendingDeposit{},
+		marginShortTrades:   map[string]bool{},
+		residuals:           []Residual{},
+		DustThresholds:      map[string]d.Decimal{},
+		placeholders:        []*placeholder{},
+		settlements:         map[string]fifo.EntryList{},
+		PlaceholderFallback: FALLBACK_ZERO,
+	}
+}
+
+// Takes units out of an account's fifo queue. Every take goes through here, so that rounding residuals
+// reconciled by the queue end up in the report.
+func (r *Ledger) take(recID, account, asset string, units d.Decimal, decimals int32, subCategory ...string) (fifo.Asset, error) {
+	if len(subCategory) == 0 {
+		if IsFiatCurrency(asset) {
+			r.bookPendingFiatDeposits(account, asset, units, decimals)
+		} else {
+			r.releasePendingDeposits(account, asset, units, decimals)
+		}
+	}
+
+	taken, err := r.accounts.Get(account, subCategory...).Take(asset, units, decimals)
+
+	// Only a shortfall is covered by a placeholder. Other errors, like a negative amount, are passed on.
+	if ferr, ok := err.(fifo.FifoError); ok && ferr.Code == fifo.ERR_NO_ENTRY && r.NegativeBalances && len(subCategory) == 0 {
+		if missing, parseErr := d.NewFromString(ferr.MissingAmount); parseErr == nil && missing.IsPositive() {
+			return r.addPlaceholder(recID, account, asset, missing, taken), nil
+		}
+	}
+
+	if err == nil && taken.Residual.IsPositive() {
+		residual := Residual{RecID: recID, Account: account, Asset: asset, Units: taken.Residual}
+
+		if len(subCategory) > 0 {
+			residual.SubCategory = subCategory[0]
+		}
+
+		r.residuals = append(r.residuals, residual)
+	}
+
+	// Margin positions are never written off.
+	if err == nil && len(subCategory) == 0 {
+		r.markDustCandidate(account, asset)
+	}
+
+	return taken, err
+}
+
+// Resolve transfers that waited too long for their counterpart. A zero time resolves all of them.
+func (r *Ledger) expire(now time.Time) {
+	r.expirePendingDeposits(now)
+	r.bookOwnWalletWithdrawals(now)
+}
+
+// Total EUR cost of the given lots, including fees payed on acquisition.
+func lotCostEur(entries fifo.EntryList) d.Decimal {
+	total := d.Zero
+
+	for _, e := range entries {
+		total = total.Add(RoundEur(e.UnitCostEur.Mul(e.UnitsLeft)).Add(RoundEur(e.UnitFeeCostEur.Mul(e.UnitsLeft))))
+	}
+
+	return RoundEur(total)
+}
@@ -0,0 +1,58 @@
+package reporting
+
+import (
+	"testing"
+	"time"
+
+	"github.com/f-taxes/german_tax_report/fifo"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResiduals(t *testing.T) {
+	D := decimal.RequireFromString
+	l := NewLedger()
+	ts := time.Date(2024, time.January, 20, 15, 0, 0, 0, time.UTC)
+
+	l.accounts.Get("Test1").Add("BTC", fifo.NewEntry("1", D("1"), D("40000"), decimal.Zero, ts))
+	l.accounts.Get("Test1", "margin").Add("BTC", fifo.NewEntry("2", D("1"), D("40000"), decimal.Zero, ts))
+
+	// Shortfalls within the tolerance are written off, and the queue they come from is kept.
+	_, err := l.take("3", "Test1", "BTC", D("1.00000004"), 8)
+	require.NoError(t, err)
+	_, err = l.take("4", "Test1", "BTC", D("1.00000005"), 8, "margin")
+	require.NoError(t, err)
+
+	assert.Equal(t, []Residual{
+		{RecID: "3", Account: "Test1", Asset: "BTC", Units: D("0.00000004")},
+		{RecID: "4", Account: "Test1", SubCategory: "margin", Asset: "BTC", Units: D("0.00000005")},
+	}, l.residuals)
+}
+
+func TestTakeErrors(t *testing.T) {
+	D := decimal.RequireFromString
+	l := NewLedger()
+	l.NegativeBalances = true
+	l.accounts.Get("Test1").Add("BTC", fifo.NewEntry("1", D("1"), D("40000"), decimal.Zero, time.Date(2024, time.January, 20, 15, 0, 0, 0, time.UTC)))
+
+	// A negative amount is an error, not a shortfall.
+	_, err := l.take("2", "Test1", "BTC", D("-0.5"), 8)
+	assert.True(t, fifo.IsFifoError(err))
+	assert.Equal(t, fifo.ERR_INVALID_AMOUNT, err.(fifo.FifoError).Code)
+	assert.Empty(t, l.placeholders)
+	assert.Equal(t, "1", l.accounts.Get("Test1").Read("BTC").Total)
+
+	// Shortfalls become placeholders, also for assets the account never held.
+	taken, err := l.take("3", "Test1", "BTC", D("1.5"), 8)
+	require.NoError(t, err)
+	assert.Equal(t, "1.5", taken.Total)
+
+	taken, err = l.take("4", "Test1", "ETH", D("2"), 8)
+	require.NoError(t, err)
+	assert.Equal(t, "2", taken.Total)
+
+	require.Len(t, l.placeholders, 2)
+	assert.Equal(t, "0.5", l.placeholders[0].Units.String())
+	assert.Equal(t, "2", l.placeholders[1].Units.String())
+}
@@ -0,0 +1,65 @@
+package reporting
+
+// TransferLink is a manual override for the transfer matching. It either pairs a withdrawal with a deposit,
+// regardless of what the automatic matching would do, or prevents the two from being paired if Unlink is set.
+type TransferLink struct {
+	Withdrawal string `json:"withdrawal"` // TxID of the withdrawal.
+	Deposit    string `json:"deposit"`    // TxID of the deposit.
+	Unlink     bool   `json:"unlink"`
+}
+
+type TransferLinks []TransferLink
+
+// LinkedWithdrawals returns the TxIDs of the withdrawals that were manually linked to the given deposit.
+// More than one withdrawal means they were merged into a single deposit.
+func (l TransferLinks) LinkedWithdrawals(depositID string) []string {
+	ids := []string{}
+
+	for _, link := range l {
+		if !link.Unlink && link.Deposit == depositID {
+			ids = append(ids, link.Withdrawal)
+		}
+	}
+
+	return ids
+}
+
+// IsLinked reports whether the withdrawal was manually linked to any deposit.
+func (l TransferLinks) IsLinked(withdrawalID string) bool {
+	for _, link := range l {
+		if !link.Unlink && link.Withdrawal == withdrawalID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsUnlinked reports whether matching the withdrawal with the deposit was manually ruled out.
+func (l TransferLinks) IsUnlinked(withdrawalID, depositID string) bool {
+	for _, link := range l {
+		if link.Unlink && link.Withdrawal == withdrawalID && link.Deposit == depositID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Set adds the link or replaces an existing one for the same pair of transfers.
+func (l TransferLinks) Set(link TransferLink) TransferLinks {
+	return append(l.Remove(link.Withdrawal, link.Deposit), link)
+}
+
+// Remove deletes the link between the two transfers, if there is one.
+func (l TransferLinks) Remove(withdrawalID, depositID string) TransferLinks {
+	out := TransferLinks{}
+
+	for _, link := range l {
+		if link.Withdrawal != withdrawalID || link.Deposit != depositID {
+			out = append(out, link)
+		}
+	}
+
+	return out
+}
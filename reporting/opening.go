@@ -0,0 +1,70 @@
+package reporting
+
+import (
+	"time"
+
+	"github.com/f-taxes/german_tax_report/fifo"
+	. "github.com/f-taxes/german_tax_report/global"
+	d "github.com/shopspring/decimal"
+)
+
+// OpeningBalance is a holding that was acquired before the records in f-taxes start,
+// for example on a platform that no longer exists.
+type OpeningBalance struct {
+	ID       string    `json:"id"`
+	Account  string    `json:"account"`
+	Asset    string    `json:"asset"`
+	Units    string    `json:"units"`
+	CostEur  string    `json:"costEur"`  // Total acquisition cost in EUR.
+	Acquired time.Time `json:"acquired"` // Acquisition date, which determines the holding period.
+}
+
+type OpeningBalances []OpeningBalance
+
+// Set adds the opening balance or replaces an existing one with the same ID.
+func (o OpeningBalances) Set(balance OpeningBalance) OpeningBalances {
+	return append(o.Remove(balance.ID), balance)
+}
+
+// Remove deletes the opening balance with the given ID, if there is one.
+func (o OpeningBalances) Remove(id string) OpeningBalances {
+	out := OpeningBalances{}
+
+	for _, b := range o {
+		if b.ID != id {
+			out = append(out, b)
+		}
+	}
+
+	return out
+}
+
+// Put the opening balances into the fifo queues before any record is processed.
+func (r *Generator) addOpeningBalances() {
+	for _, b := range r.OpeningBalances {
+		units := D(b.Units)
+
+		if !units.IsPositive() {
+			continue
+		}
+
+		entry := fifo.NewEntry(b.ID, units, D(b.CostEur), d.Zero, b.Acquired)
+		acc := r.accounts.Get(b.Account)
+
+		deposit := &Deposit{
+			Ts:      b.Acquired,
+			Type:    "deposit",
+			Account: b.Account,
+			Asset:   b.Asset,
+			Amount:  units,
+			Source:  "Opening balance",
+			Entries: fifo.EntryList{entry},
+		}
+
+		deposit.QueueBefore = append(deposit.QueueBefore, acc.Snapshot(b.Asset))
+		acc.Add(b.Asset, entry.Copy())
+		deposit.QueueAfter = append(deposit.QueueAfter, acc.Snapshot(b.Asset))
+
+		r.Recs = append(r.Recs, deposit)
+	}
+}
@@ -0,0 +1,64 @@
+package reporting
+
+import (
+	"testing"
+	"time"
+
+	"github.com/f-taxes/german_tax_report/proto"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpeningBalances(t *testing.T) {
+	units := decimal.RequireFromString
+	acquired := time.Date(2020, time.May, 1, 0, 0, 0, 0, time.UTC)
+
+	r := NewGenerator()
+	r.OpeningBalances = OpeningBalances{
+		{ID: "old-btc", Account: "A", Asset: "BTC", Units: "0.5", CostEur: "4000", Acquired: acquired},
+		{ID: "old-eth", Account: "A", Asset: "ETH", Units: "0", CostEur: "100", Acquired: acquired},
+	}
+	r.addOpeningBalances()
+
+	// Only balances with units end up in the queues, as lots with the given cost and acquisition date.
+	lots := r.accounts.Get("A").Read("BTC").Entries
+	if assert.Len(t, lots, 1) {
+		assert.Equal(t, "old-btc", lots[0].OriginTxID)
+		assert.Equal(t, "0.5", lots[0].UnitsLeft.String())
+		assert.Equal(t, "8000", lots[0].UnitCostEur.String())
+		assert.Equal(t, acquired, lots[0].Ts)
+	}
+	assert.False(t, r.accounts.Get("A").HasUnits("ETH"))
+
+	// Each of them shows up in the report as deposit.
+	if assert.Len(t, r.Recs, 1) {
+		dep := r.Recs[0].(*Deposit)
+		assert.Equal(t, "Opening balance", dep.Source)
+		assert.Equal(t, acquired, dep.Ts)
+		assert.Equal(t, "0.5", dep.QueueAfter[0].Asset().Total)
+	}
+
+	// A later sale uses the lot instead of failing for lack of units. It was held for more than a year.
+	r.process(propertyTrade("sell", time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC), "A", proto.TxAction_SELL, units("0.5"), units("50000")))
+
+	c := conversion(r, "sell")
+	assert.Empty(t, c.Error)
+	assert.Equal(t, "4000", c.Result.CostEur.String())
+
+	matches := r.Report().Matches
+	if assert.Len(t, matches, 1) {
+		assert.Equal(t, "old-btc", matches[0].OriginTxID)
+		assert.Equal(t, "21000", matches[0].GainEur.String())
+		assert.False(t, matches[0].Taxable)
+	}
+}
+
+func TestOpeningBalancesSet(t *testing.T) {
+	balances := OpeningBalances{}.
+		Set(OpeningBalance{ID: "a", Units: "1"}).
+		Set(OpeningBalance{ID: "b", Units: "2"}).
+		Set(OpeningBalance{ID: "a", Units: "3"})
+
+	assert.Equal(t, OpeningBalances{{ID: "b", Units: "2"}, {ID: "a", Units: "3"}}, balances)
+	assert.Equal(t, OpeningBalances{{ID: "a", Units: "3"}}, balances.Remove("b"))
+}
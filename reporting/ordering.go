@@ -0,0 +1,46 @@
+package reporting
+
+import (
+	"sort"
+
+	"github.com/f-taxes/german_tax_report/proto"
+)
+
+// RECORD_ORDERING describes the order records are processed in. Records are sorted by timestamp. Records with
+// the same timestamp are processed deposits first, then trades, then withdrawals, and by TxID within each kind.
+// Deposits go first so that units arriving at the same time as a trade or withdrawal are available to it.
+// The ordering is part of the report and of checkpoints, so that runs on the same data give identical results.
+const RECORD_ORDERING = "ts,deposit<trade<withdrawal,txid"
+
+// Rank of a record among records with the same timestamp.
+func recordRank(rec *proto.Record) int {
+	switch {
+	case rec.Transfer != nil && rec.Transfer.Action == proto.TransferAction_DEPOSIT:
+		return 0
+	case rec.Trade != nil:
+		return 1
+	case rec.Transfer != nil && rec.Transfer.Action == proto.TransferAction_WITHDRAWAL:
+		return 2
+	}
+
+	return 3
+}
+
+// Sort records into the order described by RECORD_ORDERING.
+func SortRecords(recs []*proto.Record) {
+	sort.SliceStable(recs, func(i, j int) bool {
+		a, b := recs[i], recs[j]
+		idA, tsA := recordInfo(a)
+		idB, tsB := recordInfo(b)
+
+		if !tsA.Equal(tsB) {
+			return tsA.Before(tsB)
+		}
+
+		if rankA, rankB := recordRank(a), recordRank(b); rankA != rankB {
+			return rankA < rankB
+		}
+
+		return idA < idB
+	})
+}
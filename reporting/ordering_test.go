@@ -0,0 +1,41 @@
+package reporting
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/f-taxes/german_tax_report/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestSortRecords(t *testing.T) {
+	ts := timestamppb.New(time.Date(2024, time.January, 20, 15, 0, 0, 0, time.UTC))
+	earlier := timestamppb.New(ts.AsTime().Add(-time.Millisecond))
+
+	recs := []*proto.Record{
+		{Transfer: &proto.Transfer{TxID: "w1", Ts: ts, Action: proto.TransferAction_WITHDRAWAL}},
+		{Trade: &proto.Trade{TxID: "t2", Ts: ts}},
+		{Trade: &proto.Trade{TxID: "t1", Ts: ts}},
+		{Transfer: &proto.Transfer{TxID: "d1", Ts: ts, Action: proto.TransferAction_DEPOSIT}},
+		{Transfer: &proto.Transfer{TxID: "w0", Ts: earlier, Action: proto.TransferAction_WITHDRAWAL}},
+	}
+
+	// The order the records arrive in doesn't matter.
+	for seed := int64(1); seed <= 10; seed++ {
+		rand.New(rand.NewSource(seed)).Shuffle(len(recs), func(i, j int) {
+			recs[i], recs[j] = recs[j], recs[i]
+		})
+
+		SortRecords(recs)
+
+		ids := []string{}
+		for _, rec := range recs {
+			id, _ := recordInfo(rec)
+			ids = append(ids, id)
+		}
+
+		assert.Equal(t, []string{"w0", "d1", "t1", "t2", "w1"}, ids)
+	}
+}
@@ -0,0 +1,243 @@
+package reporting
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/f-taxes/german_tax_report/fifo"
+	. "github.com/f-taxes/german_tax_report/global"
+	d "github.com/shopspring/decimal"
+)
+
+// Cost basis of placeholder units that were never settled by a later acquisition.
+const (
+	FALLBACK_ZERO   = "zero"   // No cost basis, the whole proceeds are gain.
+	FALLBACK_MARKET = "market" // Market value at the time of the disposal, which results in neither gain nor loss.
+)
+
+// placeholder stands in for units an account disposed of without holding them. Lots acquired later
+// settle it and provide the cost basis of those units after the fact.
+type placeholder struct {
+	ID        string
+	RecID     string
+	Account   string
+	Asset     string
+	Units     d.Decimal
+	Unsettled d.Decimal
+}
+
+// Record a placeholder lot for units missing in the queue, so the take can go ahead with a negative balance.
+func (r *Ledger) addPlaceholder(recID, account, asset string, missing d.Decimal, taken fifo.Asset) fifo.Asset {
+	p := newPlaceholder(fmt.Sprintf("%s/unknown-%d", recID, len(r.placeholders)+1), recID, account, asset, missing)
+	r.placeholders = append(r.placeholders, p)
+
+	taken.Name = asset
+	taken.Entries = append(taken.Entries, p.lot(r.now))
+	taken.Total = taken.Entries.TotalUnitsLeft().String()
+
+	return taken
+}
+
+func newPlaceholder(id, recID, account, asset string, units d.Decimal) *placeholder {
+	return &placeholder{
+		ID:        id,
+		RecID:     recID,
+		Account:   account,
+		Asset:     asset,
+		Units:     units,
+		Unsettled: units,
+	}
+}
+
+// A lot standing in for the placeholder's units, without a cost basis until it's resolved.
+func (p *placeholder) lot(ts time.Time) fifo.Entry {
+	return fifo.Entry{
+		ID:             p.ID,
+		OriginTxID:     p.RecID,
+		PlaceholderID:  p.ID,
+		Units:          p.Units,
+		UnitsLeft:      p.Units,
+		UnitCost:       d.Zero,
+		UnitCostEur:    d.Zero,
+		UnitFeeCost:    d.Zero,
+		UnitFeeCostEur: d.Zero,
+		Ts:             ts,
+	}
+}
+
+// Adds a lot to an account's fifo queue. Open placeholders of the asset are settled first, oldest first,
+// and only what is left of the lot goes into the queue. A placeholder lot transferred in from another account
+// settles them too, it's resolved by whatever settles its own placeholder.
+func (r *Ledger) add(account, asset string, e fifo.Entry) {
+	for _, p := range r.placeholders {
+		if !e.UnitsLeft.IsPositive() {
+			return
+		}
+
+		if p.Account != account || p.Asset != asset || !p.Unsettled.IsPositive() {
+			continue
+		}
+
+		units := d.Min(p.Unsettled, e.UnitsLeft)
+		part := e.Copy()
+
+		if units.LessThan(e.UnitsLeft) {
+			part = e.SplitOff(units)
+		}
+
+		e.UnitsLeft = e.UnitsLeft.Sub(units)
+		p.Unsettled = p.Unsettled.Sub(units)
+		r.settlements[p.ID] = append(r.settlements[p.ID], part)
+	}
+
+	if e.UnitsLeft.IsPositive() {
+		r.accounts.Get(account).Add(asset, e)
+	}
+}
+
+// Replace the placeholder lots of all final disposals with the lots that settled them. Units that were never
+// settled get the fallback cost basis.
+func (r *Ledger) backfillPlaceholders() {
+	if len(r.placeholders) == 0 {
+		return
+	}
+
+	for _, rec := range r.Recs {
+		switch v := rec.(type) {
+		case *Conversion:
+			if len(v.FromEntries) == 0 {
+				continue
+			}
+
+			total := v.FromEntries[0].Entries.TotalUnitsLeft()
+			marketPrice := d.Zero
+
+			if total.IsPositive() {
+				marketPrice = v.Result.ValueEur.DivRound(total, Precision.UnitPrice)
+			}
+
+			changed := false
+
+			for i := range v.FromEntries {
+				var warning string
+				v.FromEntries[i].Entries, warning = r.resolvePlaceholders(v.FromEntries[i].Entries, marketPrice, i == 0 && total.IsPositive(), v.Ts)
+
+				if warning != "" {
+					v.Warning = joinMessages(v.Warning, warning)
+					v.FromEntries[i].Total = v.FromEntries[i].Entries.TotalUnitsLeft().String()
+					changed = changed || i == 0
+				}
+			}
+
+			if changed {
+				v.Result.CostEur = lotCostEur(v.FromEntries[0].Entries)
+				v.Result.PnlEur = RoundEur(v.Result.ValueEur.Sub(v.Result.CostEur))
+			}
+		case *Withdrawal:
+			// Only units that didn't arrive in another account leave for good. The others are resolved where they are disposed.
+			price, _, ok := r.lookupEurPrice(v.Asset, v.Ts)
+
+			var warning string
+			v.remaining, warning = r.resolvePlaceholders(v.remaining, price, ok, v.Ts)
+			v.Warning = joinMessages(v.Warning, warning)
+		case *DustWriteOff:
+			var warning string
+			v.Entries, warning = r.resolvePlaceholders(v.Entries, d.Zero, false, v.Ts)
+			v.Warning = joinMessages(v.Warning, warning)
+		}
+	}
+}
+
+// Replace placeholder lots with the lots that settled them, in the order they were acquired.
+// The market price is the EUR value of a unit at the time of the disposal, used for the market value fallback.
+// Without a known market price, unsettled units fall back to 0€.
+func (r *Ledger) resolvePlaceholders(entries fifo.EntryList, marketPrice d.Decimal, priceKnown bool, disposed time.Time) (fifo.EntryList, string) {
+	out := fifo.EntryList{}
+	settled := d.Zero
+	unsettled := d.Zero
+	atMarket := r.PlaceholderFallback == FALLBACK_MARKET && priceKnown
+
+	for _, e := range entries {
+		out = append(out, r.resolvePlaceholder(e, IfThen(atMarket, marketPrice, d.Zero), disposed, map[string]bool{}, &settled, &unsettled)...)
+	}
+
+	warning := ""
+
+	if settled.IsPositive() {
+		warning = fmt.Sprintf("%s units were disposed of before they were acquired. Their cost basis comes from the acquisitions that followed.", settled)
+	}
+
+	if unsettled.IsPositive() {
+		basis := IfThen(atMarket, "the market value", "0€")
+
+		if r.PlaceholderFallback == FALLBACK_MARKET && !priceKnown {
+			basis = "0€, as no market price is available"
+		}
+
+		warning = joinMessages(warning, fmt.Sprintf("%s units of unknown origin were never settled by a later acquisition. Their cost basis is assumed to be %s.", unsettled, basis))
+	}
+
+	return out, warning
+}
+
+// Replace a single lot if it's a placeholder. Units that were never settled get the given fallback price. A placeholder lot that was transferred to another account may have settled
+// a placeholder there, so the lots that settled a placeholder are resolved in turn. Placeholders already being resolved
+// further up the chain are skipped, as lots moving back and forth could settle each other.
+func (r *Ledger) resolvePlaceholder(e fifo.Entry, fallbackPrice d.Decimal, disposed time.Time, resolving map[string]bool, settled, unsettled *d.Decimal) fifo.EntryList {
+	if e.PlaceholderID == "" {
+		return fifo.EntryList{e}
+	}
+
+	out := fifo.EntryList{}
+	rest := e.UnitsLeft
+
+	if !resolving[e.PlaceholderID] {
+		resolving[e.PlaceholderID] = true
+
+		for len(r.settlements[e.PlaceholderID]) > 0 && rest.IsPositive() {
+			lots := r.settlements[e.PlaceholderID]
+			units := d.Min(rest, lots[0].UnitsLeft)
+
+			lot := lots[0].Copy()
+			lot.UnitsLeft = units
+
+			lots[0].UnitsLeft = lots[0].UnitsLeft.Sub(units)
+			if !lots[0].UnitsLeft.IsPositive() {
+				lots = lots[1:]
+			}
+
+			r.settlements[e.PlaceholderID] = lots
+			rest = rest.Sub(units)
+
+			if lot.PlaceholderID != "" {
+				out = append(out, r.resolvePlaceholder(lot, fallbackPrice, disposed, resolving, settled, unsettled)...)
+				continue
+			}
+
+			out = append(out, lot)
+			*settled = settled.Add(units)
+		}
+
+		delete(resolving, e.PlaceholderID)
+	}
+
+	if rest.IsPositive() {
+		fallback := e.Copy()
+		fallback.UnitsLeft = rest
+		fallback.Ts = disposed
+		fallback.UnitCostEur = fallbackPrice
+
+		out = append(out, fallback)
+		*unsettled = unsettled.Add(rest)
+	}
+
+	return out
+}
+
+func joinMessages(a, b string) string {
+	if a == "" || b == "" {
+		return a + b
+	}
+
+	return a + " " + b
+}
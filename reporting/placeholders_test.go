@@ -0,0 +1,174 @@
+package reporting
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/f-taxes/german_tax_report/prices"
+	"github.com/f-taxes/german_tax_report/proto"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func placeholderTrade(id string, minute int, account string, action proto.TxAction, units, price string) *proto.Record {
+	return propertyTrade(id, transferStart.Add(time.Duration(minute)*time.Minute), account, action, decimal.RequireFromString(units), decimal.RequireFromString(price))
+}
+
+// Runs the records with negative balances and resolves the placeholders like the end of a run does.
+func runPlaceholders(fallback string, recs ...*proto.Record) *Generator {
+	r := NewGenerator()
+	r.NegativeBalances = true
+	r.PlaceholderFallback = fallback
+
+	for _, rec := range recs {
+		r.process(rec)
+	}
+
+	r.expire(time.Time{})
+	r.backfillPlaceholders()
+
+	return r
+}
+
+func withdrawal(r *Generator, recID string) *Withdrawal {
+	for _, rec := range r.Recs {
+		if w, ok := rec.(*Withdrawal); ok && w.RecID == recID {
+			return w
+		}
+	}
+
+	return nil
+}
+
+func conversion(r *Generator, recID string) *Conversion {
+	for _, rec := range r.Recs {
+		if c, ok := rec.(*Conversion); ok && c.RecID == recID {
+			return c
+		}
+	}
+
+	return nil
+}
+
+func originsOf(c *Conversion) []string {
+	out := []string{}
+
+	for _, e := range c.FromEntries[0].Entries {
+		out = append(out, e.OriginTxID)
+	}
+
+	return out
+}
+
+func TestPlaceholders(t *testing.T) {
+	t.Run("settled by a later buy", func(t *testing.T) {
+		r := runPlaceholders(FALLBACK_ZERO,
+			placeholderTrade("sell", 0, "B", proto.TxAction_SELL, "0.2", "35000"),
+			placeholderTrade("buy", 60, "B", proto.TxAction_BUY, "0.3", "25000"),
+		)
+
+		sell := conversion(r, "sell")
+		assert.Equal(t, []string{"buy"}, originsOf(sell))
+		assert.Equal(t, "5000", sell.Result.CostEur.String())
+		assert.Equal(t, "2000", sell.Result.PnlEur.String())
+		assert.Contains(t, sell.Warning, "disposed of before they were acquired")
+
+		// Only what is left of the buy stays in the queue.
+		assert.Equal(t, "0.1", r.accounts.Get("B").Read("BTC").Total)
+	})
+
+	t.Run("settled by a transferred in deposit", func(t *testing.T) {
+		r := runPlaceholders(FALLBACK_ZERO,
+			placeholderTrade("buy", 0, "A", proto.TxAction_BUY, "1", "30000"),
+			placeholderTrade("sell", 10, "B", proto.TxAction_SELL, "0.2", "35000"),
+			withdrawalRec("w1", 20, "A", "B", "BTC", "0.2"),
+			depositRec("d1", 22, "B", "BTC", "0.2"),
+		)
+
+		sell := conversion(r, "sell")
+		assert.Equal(t, []string{"buy"}, originsOf(sell))
+		assert.Equal(t, "6000", sell.Result.CostEur.String())
+		assert.False(t, r.accounts.Get("B").HasUnits("BTC"))
+	})
+
+	t.Run("never settled with a zero cost basis", func(t *testing.T) {
+		r := runPlaceholders(FALLBACK_ZERO,
+			placeholderTrade("sell", 0, "B", proto.TxAction_SELL, "0.2", "35000"),
+		)
+
+		sell := conversion(r, "sell")
+		assert.Equal(t, "0", sell.Result.CostEur.String())
+		assert.Equal(t, "7000", sell.Result.PnlEur.String())
+		assert.Contains(t, sell.Warning, "assumed to be 0€")
+	})
+
+	t.Run("never settled with the market value as cost basis", func(t *testing.T) {
+		r := runPlaceholders(FALLBACK_MARKET,
+			placeholderTrade("sell", 0, "B", proto.TxAction_SELL, "0.2", "35000"),
+		)
+
+		sell := conversion(r, "sell")
+		assert.Equal(t, "7000", sell.Result.CostEur.String())
+		assert.Equal(t, "0", sell.Result.PnlEur.String())
+		assert.Contains(t, sell.Warning, "assumed to be the market value")
+	})
+
+	t.Run("placeholder lot transferred to an account with a placeholder", func(t *testing.T) {
+		r := runPlaceholders(FALLBACK_ZERO,
+			placeholderTrade("sell", 0, "B", proto.TxAction_SELL, "0.2", "35000"),
+			withdrawalRec("w1", 10, "A", "B", "BTC", "0.2"),
+			depositRec("d1", 12, "B", "BTC", "0.2"),
+			placeholderTrade("buy", 60, "A", proto.TxAction_BUY, "0.2", "20000"),
+		)
+
+		// The sale in B is settled by the lot A acquired after sending the units.
+		sell := conversion(r, "sell")
+		assert.Equal(t, []string{"buy"}, originsOf(sell))
+		assert.Empty(t, sell.FromEntries[0].Entries[0].PlaceholderID)
+		assert.Equal(t, "4000", sell.Result.CostEur.String())
+		assert.NotContains(t, sell.Warning, "never settled")
+		assert.False(t, r.accounts.Get("A").HasUnits("BTC"))
+		assert.False(t, r.accounts.Get("B").HasUnits("BTC"))
+	})
+
+	t.Run("placeholder lots sent back and forth", func(t *testing.T) {
+		r := runPlaceholders(FALLBACK_ZERO,
+			placeholderTrade("sell-a", 0, "A", proto.TxAction_SELL, "0.1", "35000"),
+			placeholderTrade("sell-b", 1, "B", proto.TxAction_SELL, "0.1", "35000"),
+			withdrawalRec("w1", 10, "A", "B", "BTC", "0.1"),
+			depositRec("d1", 12, "B", "BTC", "0.1"),
+			withdrawalRec("w2", 30, "B", "A", "BTC", "0.1"),
+			depositRec("d2", 32, "A", "BTC", "0.1"),
+		)
+
+		// Nothing was ever acquired, so both sales fall back instead of resolving each other forever.
+		assert.Equal(t, "0", conversion(r, "sell-a").Result.CostEur.String())
+		assert.Equal(t, "0", conversion(r, "sell-b").Result.CostEur.String())
+	})
+
+	t.Run("withdrawal never settled with the market value as cost basis", func(t *testing.T) {
+		r := NewGenerator()
+		r.NegativeBalances = true
+		r.PlaceholderFallback = FALLBACK_MARKET
+		r.Prices = prices.New()
+		require.NoError(t, r.Prices.Import("BTC", strings.NewReader("2024-01-20,40000\n")))
+
+		r.process(withdrawalRec("w1", 0, "A", "shop", "BTC", "0.1"))
+		r.expire(time.Time{})
+		r.backfillPlaceholders()
+
+		w := withdrawal(r, "w1")
+		assert.Equal(t, "40000", w.remaining[0].UnitCostEur.String())
+		assert.Contains(t, w.Warning, "assumed to be the market value")
+	})
+
+	t.Run("withdrawal never settled without a market price", func(t *testing.T) {
+		r := runPlaceholders(FALLBACK_MARKET, withdrawalRec("w1", 0, "A", "shop", "BTC", "0.1"))
+
+		w := withdrawal(r, "w1")
+		assert.True(t, w.remaining[0].UnitCostEur.IsZero())
+		assert.Contains(t, w.Warning, "assumed to be 0€, as no market price is available")
+	})
+}
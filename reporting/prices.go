@@ -0,0 +1,124 @@
+package reporting
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	. "github.com/f-taxes/german_tax_report/global"
+	"github.com/f-taxes/german_tax_report/proto"
+	d "github.com/shopspring/decimal"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// Look up the EUR price of an asset in the local price database or, for fiat currencies, in the reference rates.
+func (r *Ledger) lookupEurPrice(asset string, ts time.Time) (d.Decimal, string, bool) {
+	if IsCash(asset) {
+		return D("1"), "", true
+	}
+
+	if price, day, ok := r.Prices.Price(asset, ts); ok {
+		return price, fmt.Sprintf("%s from price database (%s)", asset, day.Format(time.DateOnly)), true
+	}
+
+	if IsFiatCurrency(asset) {
+		if price, day, ok := r.FxRates.EurPrice(asset, ts); ok {
+			return price, fmt.Sprintf("%s from ECB reference rate (%s)", asset, day.Format(time.DateOnly)), true
+		}
+	}
+
+	return d.Zero, "", false
+}
+
+// Fill in EUR values the host didn't provide, using local price sources. The values are filled into a copy of the
+// trade, the record as streamed stays as it is. Returns the copy along with a description of the price sources that
+// were used and a warning about values that couldn't be found anywhere.
+func (r *Ledger) fillMissingPrices(original *proto.Trade) (trade *proto.Trade, source string, warning string) {
+	trade = protobuf.Clone(original).(*proto.Trade)
+	ts := trade.Ts.AsTime()
+	sources := []string{}
+	missing := []string{}
+
+	lookup := func(asset string) (d.Decimal, bool) {
+		price, src, ok := r.lookupEurPrice(asset, ts)
+		if ok && src != "" {
+			sources = append(sources, src)
+		}
+		return price, ok
+	}
+
+	isMissing := func(str string) bool {
+		v, ok := DOk(str)
+		return !ok || v.IsZero()
+	}
+
+	price := D(trade.Price)
+
+	if isMissing(trade.QuotePriceC) {
+		if p, ok := lookup(trade.Quote); ok {
+			trade.QuotePriceC = p.String()
+		} else if !isMissing(trade.PriceC) && price.IsPositive() {
+			trade.QuotePriceC = D(trade.PriceC).DivRound(price, 8).String()
+		}
+	}
+
+	if isMissing(trade.PriceC) {
+		if !isMissing(trade.QuotePriceC) {
+			trade.PriceC = price.Mul(D(trade.QuotePriceC)).String()
+		} else if p, ok := lookup(trade.Asset); ok {
+			trade.PriceC = p.String()
+		} else {
+			missing = append(missing, trade.Asset)
+		}
+	}
+
+	if isMissing(trade.QuotePriceC) {
+		missing = append(missing, trade.Quote)
+	}
+
+	if isMissing(trade.ValueC) {
+		if !isMissing(trade.QuotePriceC) {
+			trade.ValueC = D(trade.Value).Mul(D(trade.QuotePriceC)).String()
+		} else if !isMissing(trade.PriceC) {
+			trade.ValueC = D(trade.Amount).Mul(D(trade.PriceC)).String()
+		}
+	}
+
+	for _, fee := range []*proto.Cost{trade.Fee, trade.QuoteFee} {
+		if fee == nil || isMissing(fee.Amount) || !isMissing(fee.AmountC) {
+			continue
+		}
+
+		var p d.Decimal
+		var ok bool
+
+		switch fee.Currency {
+		case trade.Asset:
+			p, ok = D(trade.PriceC), !isMissing(trade.PriceC)
+		case trade.Quote:
+			p, ok = D(trade.QuotePriceC), !isMissing(trade.QuotePriceC)
+		default:
+			p, ok = lookup(fee.Currency)
+		}
+
+		if !ok {
+			missing = append(missing, fee.Currency)
+			continue
+		}
+
+		fee.PriceC = p.String()
+		fee.AmountC = D(fee.Amount).Mul(p).String()
+	}
+
+	if len(sources) > 0 {
+		source = strings.Join(sources, ", ")
+	} else {
+		source = IfThen(trade.PriceConvertedBy != "", trade.PriceConvertedBy, "f-taxes")
+	}
+
+	if len(missing) > 0 {
+		warning = fmt.Sprintf("No EUR price for %s available. Affected values are set to 0€.", strings.Join(missing, ", "))
+	}
+
+	return
+}
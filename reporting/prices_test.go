@@ -0,0 +1,78 @@
+package reporting
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/f-taxes/german_tax_report/prices"
+	"github.com/f-taxes/german_tax_report/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// A purchase of 0.1 BTC for 4000 USDT the host had no EUR prices for.
+func unpricedTrade() *proto.Trade {
+	return &proto.Trade{
+		TxID: "buy", Ts: timestamppb.New(transferStart), Account: "A", Ticker: "BTC/USDT", Asset: "BTC", Quote: "USDT", Action: proto.TxAction_BUY,
+		Amount: "0.1", Price: "40000", Value: "4000", AssetDecimals: 8, QuoteDecimals: 8,
+		Fee: &proto.Cost{}, QuoteFee: &proto.Cost{}, Props: &proto.Props{},
+	}
+}
+
+func TestFillMissingPrices(t *testing.T) {
+	t.Run("quote price from the price database", func(t *testing.T) {
+		r := NewGenerator()
+		r.Prices = prices.New()
+		require.NoError(t, r.Prices.Import("USDT", strings.NewReader("2024-01-19,0.9\n")))
+
+		trade := unpricedTrade()
+		c := r.TradeToConversion(trade)
+
+		assert.Equal(t, "36000", c.PriceEur.String())
+		assert.Equal(t, "3600", c.FromAmountEur.String())
+		assert.Equal(t, "3600", c.ToAmountEur.String())
+		assert.Equal(t, "USDT from price database (2024-01-19)", c.PriceSource)
+		assert.Empty(t, c.Warning)
+
+		// The streamed trade is left as it is.
+		assert.Empty(t, trade.PriceC)
+		assert.Empty(t, trade.QuotePriceC)
+		assert.Empty(t, trade.ValueC)
+	})
+
+	t.Run("asset price from the price database", func(t *testing.T) {
+		r := NewGenerator()
+		r.Prices = prices.New()
+		require.NoError(t, r.Prices.Import("BTC", strings.NewReader("2024-01-20,36000\n")))
+
+		c := r.TradeToConversion(unpricedTrade())
+
+		assert.Equal(t, "36000", c.PriceEur.String())
+		assert.Equal(t, "3600", c.FromAmountEur.String())
+		assert.Equal(t, "BTC from price database (2024-01-20)", c.PriceSource)
+	})
+
+	t.Run("no price anywhere", func(t *testing.T) {
+		c := NewGenerator().TradeToConversion(unpricedTrade())
+
+		assert.Equal(t, "0", c.FromAmountEur.String())
+		assert.Equal(t, "No EUR price for BTC, USDT available. Affected values are set to 0€.", c.Warning)
+	})
+
+	t.Run("prices given by the host", func(t *testing.T) {
+		trade := unpricedTrade()
+		trade.PriceC, trade.QuotePriceC, trade.ValueC = "37000", "0.925", "3700"
+		trade.PriceConvertedBy = "ECB reference rate 2024-01-19"
+
+		r := NewGenerator()
+		r.Prices = prices.New()
+		require.NoError(t, r.Prices.Import("USDT", strings.NewReader("2024-01-19,0.9\n")))
+
+		c := r.TradeToConversion(trade)
+
+		assert.Equal(t, "37000", c.PriceEur.String())
+		assert.Equal(t, "3700", c.FromAmountEur.String())
+		assert.Equal(t, "ECB reference rate 2024-01-19", c.PriceSource)
+	})
+}
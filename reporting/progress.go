@@ -0,0 +1,122 @@
+package reporting
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "github.com/f-taxes/german_tax_report/global"
+	g "github.com/f-taxes/german_tax_report/grpc_client"
+	"github.com/f-taxes/german_tax_report/proto"
+	"github.com/kataras/golog"
+)
+
+// Phases of a generation run.
+const (
+	PHASE_STREAMING   = "streaming"   // Records are received from f-taxes.
+	PHASE_MATCHING    = "matching"    // Records are processed and matched with each other.
+	PHASE_SUMMARIZING = "summarizing" // Transfers are resolved and withdrawals classified.
+	PHASE_DONE        = "done"
+)
+
+// Range of the overall progress each phase covers, in percent.
+var phaseRange = map[string][2]int{
+	PHASE_STREAMING:   {0, 50},
+	PHASE_MATCHING:    {50, 95},
+	PHASE_SUMMARIZING: {95, 95},
+	PHASE_DONE:        {100, 100},
+}
+
+// Progress of a generation run.
+type Progress struct {
+	JobID     string
+	Phase     string
+	Streamed  int       // Records received so far.
+	Processed int       // Records processed so far.
+	From      time.Time // Date range of the run.
+	To        time.Time
+	Current   time.Time // Time of the last record received or processed.
+	Percent   int       // Overall progress, weighing the phases by the time they usually take.
+	Error     string    // Why the run ended early, if it did.
+}
+
+func (p Progress) String() string {
+	if p.Error != "" {
+		return "Tax report: failed"
+	}
+
+	switch p.Phase {
+	case PHASE_STREAMING:
+		return fmt.Sprintf("Tax report: receiving records (%d so far)", p.Streamed)
+	case PHASE_MATCHING:
+		return fmt.Sprintf("Tax report: processing records (%d of %d)", p.Processed, p.Streamed)
+	case PHASE_SUMMARIZING:
+		return "Tax report: summarizing"
+	}
+
+	return "Tax report: done"
+}
+
+// How far the phase got through the date range, in percent.
+func (p Progress) phasePercent() int {
+	span := p.To.Sub(p.From)
+
+	if span <= 0 || p.Current.Before(p.From) {
+		return 0
+	}
+
+	if !p.Current.Before(p.To) {
+		return 100
+	}
+
+	return int(p.Current.Sub(p.From) * 100 / span)
+}
+
+// Progress returns the progress of the current or last run.
+func (r *Generator) Progress() Progress {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	return r.progress
+}
+
+// Update the progress and pass it on to f-taxes if it changed noticeably.
+func (r *Generator) updateProgress(update func(p *Progress)) {
+	r.l.Lock()
+
+	before := r.progress
+	update(&r.progress)
+
+	p := &r.progress
+	span := phaseRange[p.Phase]
+	p.Percent = span[0] + (span[1]-span[0])*p.phasePercent()/100
+
+	progress := r.progress
+	r.l.Unlock()
+
+	if progress.Phase == before.Phase && progress.Percent == before.Percent {
+		return
+	}
+
+	r.showProgress(progress)
+}
+
+// Show the progress in f-taxes. Runs with its own context, so a cancelled run can still close its job.
+func (r *Generator) showProgress(p Progress) {
+	if g.GrpcClient == nil || g.GrpcClient.GrpcClient == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	err := g.GrpcClient.ShowJobProgress(ctx, &proto.JobProgress{
+		ID:       p.JobID,
+		Label:    p.String(),
+		Progress: fmt.Sprintf("%d", p.Percent),
+	})
+
+	if err != nil {
+		golog.Debugf("Failed to report progress of %s: %v", Plugin.ID, err)
+	}
+}
@@ -0,0 +1,32 @@
+package reporting
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgress(t *testing.T) {
+	from := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(1, 0, 0)
+	r := NewGenerator()
+
+	r.updateProgress(func(p *Progress) {
+		*p = Progress{Phase: PHASE_STREAMING, From: from, To: to, Current: from.Add(to.Sub(from) / 2)}
+	})
+	assert.Equal(t, 25, r.Progress().Percent)
+
+	// Each phase covers its own share of the overall progress.
+	r.updateProgress(func(p *Progress) {
+		p.Phase = PHASE_MATCHING
+		p.Current = to
+	})
+	assert.Equal(t, 95, r.Progress().Percent)
+
+	r.updateProgress(func(p *Progress) {
+		p.Phase = PHASE_DONE
+	})
+	assert.Equal(t, 100, r.Progress().Percent)
+	assert.Equal(t, "Tax report: done", r.Progress().String())
+}
@@ -0,0 +1,183 @@
+package reporting
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/f-taxes/german_tax_report/fifo"
+	"github.com/f-taxes/german_tax_report/proto"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var propertyAccounts = []string{"A", "B", "C"}
+
+// Generates a random, valid history of deposits, trades and transfers between accounts. Holdings are tracked
+// along the way, so that nothing is ever sold or moved that isn't there.
+func randomRecords(rnd *rand.Rand, n int) []*proto.Record {
+	recs := []*proto.Record{}
+	holdings := map[string]decimal.Decimal{}
+	ts := time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC)
+
+	key := func(account, asset string) string {
+		return account + "/" + asset
+	}
+
+	for i := 0; i < n; i++ {
+		ts = ts.Add(time.Duration(rnd.Intn(600)+60) * time.Minute)
+		account := propertyAccounts[rnd.Intn(len(propertyAccounts))]
+		id := fmt.Sprintf("%d", i)
+		eur := holdings[key(account, "EUR")]
+		btc := holdings[key(account, "BTC")]
+		price := decimal.New(rnd.Int63n(50_000)+1_000, 0)
+
+		switch rnd.Intn(4) {
+		case 0:
+			amount := decimal.New(rnd.Int63n(1_000_000)+1, -2)
+			recs = append(recs, &proto.Record{Transfer: &proto.Transfer{TxID: id, Ts: timestamppb.New(ts), Account: account, Asset: "EUR", Amount: amount.String(), Action: proto.TransferAction_DEPOSIT}})
+			holdings[key(account, "EUR")] = eur.Add(amount)
+		case 1:
+			units := eur.Mul(decimal.New(rnd.Int63n(100)+1, -2)).Div(price).RoundDown(6)
+			if !units.IsPositive() {
+				continue
+			}
+			recs = append(recs, propertyTrade(id, ts, account, proto.TxAction_BUY, units, price))
+			holdings[key(account, "EUR")] = eur.Sub(units.Mul(price))
+			holdings[key(account, "BTC")] = btc.Add(units)
+		case 2:
+			units := btc.Mul(decimal.New(rnd.Int63n(100)+1, -2)).RoundDown(6)
+			if !units.IsPositive() {
+				continue
+			}
+			recs = append(recs, propertyTrade(id, ts, account, proto.TxAction_SELL, units, price))
+			holdings[key(account, "EUR")] = eur.Add(units.Mul(price))
+			holdings[key(account, "BTC")] = btc.Sub(units)
+		case 3:
+			units := btc.Mul(decimal.New(rnd.Int63n(100)+1, -2)).RoundDown(6)
+			destination := propertyAccounts[rnd.Intn(len(propertyAccounts))]
+			if !units.IsPositive() || destination == account {
+				continue
+			}
+			recs = append(recs,
+				&proto.Record{Transfer: &proto.Transfer{TxID: id + "w", Ts: timestamppb.New(ts), Account: account, Destination: destination, Asset: "BTC", Amount: units.String(), AssetDecimals: 8, Action: proto.TransferAction_WITHDRAWAL}},
+				&proto.Record{Transfer: &proto.Transfer{TxID: id + "d", Ts: timestamppb.New(ts.Add(5 * time.Minute)), Account: destination, Source: account, Asset: "BTC", Amount: units.String(), AssetDecimals: 8, Action: proto.TransferAction_DEPOSIT}},
+			)
+			holdings[key(account, "BTC")] = btc.Sub(units)
+			holdings[key(destination, "BTC")] = holdings[key(destination, "BTC")].Add(units)
+		}
+	}
+
+	return recs
+}
+
+func propertyTrade(id string, ts time.Time, account string, action proto.TxAction, units, price decimal.Decimal) *proto.Record {
+	value := units.Mul(price).String()
+
+	return &proto.Record{Trade: &proto.Trade{
+		TxID: id, Ts: timestamppb.New(ts), Account: account, Ticker: "BTC/EUR", Asset: "BTC", Quote: "EUR", Action: action,
+		Amount: units.String(), Price: price.String(), PriceC: price.String(), QuotePriceC: "1", Value: value, ValueC: value,
+		AssetDecimals: 8, QuoteDecimals: 8, Fee: &proto.Cost{}, QuoteFee: &proto.Cost{}, Props: &proto.Props{},
+	}}
+}
+
+func totalUnits(r *Generator, asset string) decimal.Decimal {
+	total := decimal.Zero
+
+	for _, account := range propertyAccounts {
+		total = total.Add(r.accounts.Get(account).Read(asset).Entries.TotalUnitsLeft())
+	}
+
+	return total
+}
+
+func totalCost(r *Generator, asset string) decimal.Decimal {
+	total := decimal.Zero
+
+	for _, account := range propertyAccounts {
+		for _, e := range r.accounts.Get(account).Read(asset).Entries {
+			total = total.Add(e.UnitCostEur.Mul(e.UnitsLeft))
+		}
+	}
+
+	return total
+}
+
+// Runs the records and checks the invariants after each of them. Returns the report as json.
+func runRecords(t *testing.T, recs []*proto.Record) string {
+	r := NewGenerator()
+	acquired, disposed := decimal.Zero, decimal.Zero
+	costBefore := decimal.Zero
+
+	for i, rec := range recs {
+		withdrawal := rec.Transfer != nil && rec.Transfer.Action == proto.TransferAction_WITHDRAWAL
+		if withdrawal {
+			costBefore = totalCost(r, "BTC")
+		}
+
+		r.process(rec)
+
+		if rec.Trade != nil {
+			units := decimal.RequireFromString(rec.Trade.Amount)
+			if rec.Trade.Action == proto.TxAction_BUY {
+				acquired = acquired.Add(units)
+			} else {
+				disposed = disposed.Add(units)
+			}
+		}
+
+		// Units are conserved, wherever they are. Withdrawn units are in transit until their deposit arrives.
+		if !withdrawal {
+			assert.True(t, totalUnits(r, "BTC").Equal(acquired.Sub(disposed)), "record %d: holding %s BTC, expected %s", i, totalUnits(r, "BTC"), acquired.Sub(disposed))
+		}
+
+		// Moving assets between accounts doesn't change their cost basis.
+		if rec.Transfer != nil && rec.Transfer.Asset == "BTC" && rec.Transfer.Action == proto.TransferAction_DEPOSIT {
+			assert.True(t, totalCost(r, "BTC").Equal(costBefore), "record %d: cost basis changed from %s to %s", i, costBefore, totalCost(r, "BTC"))
+		}
+
+		for _, account := range propertyAccounts {
+			for _, asset := range []string{"EUR", "BTC"} {
+				for _, e := range r.accounts.Get(account).Read(asset).Entries {
+					assert.False(t, e.UnitsLeft.IsNegative(), "record %d: lot %s in %s has negative units", i, e.ID, account)
+				}
+			}
+		}
+	}
+
+	for _, rec := range r.Recs {
+		if c, ok := rec.(*Conversion); ok {
+			assert.Empty(t, c.Error, "conversion %s failed", c.RecID)
+		}
+	}
+
+	r.expire(time.Time{})
+
+	for _, account := range propertyAccounts {
+		assertQueueOrdered(t, r.accounts.Get(account).Read("BTC").Entries)
+	}
+
+	report, err := json.Marshal(r.Report())
+	require.NoError(t, err)
+
+	return string(report)
+}
+
+func assertQueueOrdered(t *testing.T, entries fifo.EntryList) {
+	for i := 1; i < len(entries); i++ {
+		assert.False(t, entries[i].Ts.Before(entries[i-1].Ts), "lots are out of order")
+	}
+}
+
+func TestGeneratorProperties(t *testing.T) {
+	for seed := int64(1); seed <= 20; seed++ {
+		recs := randomRecords(rand.New(rand.NewSource(seed)), 300)
+
+		// The same records always result in the same report.
+		assert.Equal(t, runRecords(t, recs), runRecords(t, recs), "seed %d isn't deterministic", seed)
+	}
+}
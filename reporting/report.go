@@ -0,0 +1,186 @@
+package reporting
+
+import (
+	"time"
+
+	"github.com/f-taxes/german_tax_report/fifo"
+	. "github.com/f-taxes/german_tax_report/global"
+	d "github.com/shopspring/decimal"
+)
+
+// Kinds of disposals in the lot matching table.
+const (
+	DISPOSAL_CONVERSION = "conversion"
+	DISPOSAL_PAYMENT    = "payment"
+	DISPOSAL_DUST       = "dust"
+)
+
+// Report is the result of a generation run.
+type Report struct {
+	Records   []any
+	Ordering  string             // Order the records were processed in, see RECORD_ORDERING.
+	Matches   []LotMatch         // One row for each lot that was part of a disposal.
+	Gains     map[int]GainTotals // Gains and losses of all disposals by year.
+	FxGains   FxGains            // Gains and losses from disposing foreign currencies.
+	Residuals []Residual         // Shortfalls of units below the precision policy's tolerance that were written off.
+}
+
+// Residual is a tiny amount of units a take fell short by because of rounding earlier on.
+type Residual struct {
+	RecID       string
+	Account     string
+	SubCategory string // Queue the units were taken from, like "margin". Empty for the account's holdings.
+	Asset       string
+	Units       d.Decimal
+}
+
+// LotMatch pairs an acquisition lot with the disposal that used it up, in full or in part.
+type LotMatch struct {
+	RecID       string // ID of the disposing record.
+	Kind        string // One of the DISPOSAL_* kinds.
+	Account     string
+	Asset       string
+	LotID       string
+	OriginTxID  string // Record that acquired the lot.
+	Acquired    time.Time
+	Disposed    time.Time
+	Units       d.Decimal
+	CostEur     d.Decimal
+	ProceedsEur d.Decimal // Share of the disposal's proceeds, proportional to the lot's units.
+	GainEur     d.Decimal
+	Taxable     bool // Disposed within the one year holding period.
+}
+
+type GainTotals struct {
+	GainEur        d.Decimal
+	TaxableGainEur d.Decimal
+}
+
+type FxGains struct {
+	Entries []LotMatch
+	ByYear  map[int]GainTotals
+}
+
+func (r *Generator) Report() Report {
+	matches := r.lotMatches()
+
+	return Report{
+		Records:   r.Recs,
+		Ordering:  RECORD_ORDERING,
+		Matches:   matches,
+		Gains:     gainsByYear(matches),
+		FxGains:   fxGains(matches),
+		Residuals: r.residuals,
+	}
+}
+
+// Build the lot matching table from all disposals in the records.
+func (r *Generator) lotMatches() []LotMatch {
+	matches := []LotMatch{}
+
+	add := func(recID, kind, account, asset string, disposed time.Time, proceedsEur d.Decimal, entries fifo.EntryList) {
+		for _, m := range splitProceeds(disposed, proceedsEur, entries) {
+			m.RecID = recID
+			m.Kind = kind
+			m.Account = account
+			m.Asset = asset
+			matches = append(matches, m)
+		}
+	}
+
+	for _, rec := range r.Recs {
+		switch v := rec.(type) {
+		case *Conversion:
+			// Spending cash isn't a disposal. Margin positions are not taxed lot by lot.
+			if IsCash(v.From) || v.IsMarginTrade || len(v.FromEntries) == 0 {
+				continue
+			}
+
+			add(v.RecID, DISPOSAL_CONVERSION, v.Account, v.From, v.Ts, v.Result.ValueEur, v.FromEntries[0].Entries)
+		case *Withdrawal:
+			if v.Classification == CLASS_PAYMENT && v.Result != nil {
+				add(v.RecID, DISPOSAL_PAYMENT, v.Account, v.Asset, v.Ts, v.Result.ValueEur, v.remaining)
+			}
+		case *DustWriteOff:
+			add(v.RecID, DISPOSAL_DUST, v.Account, v.Asset, v.Ts, d.Zero, v.Entries)
+		}
+	}
+
+	return matches
+}
+
+func gainsByYear(matches []LotMatch) map[int]GainTotals {
+	byYear := map[int]GainTotals{}
+
+	for _, m := range matches {
+		year := m.Disposed.In(taxLocation).Year()
+
+		totals := byYear[year]
+		totals.GainEur = totals.GainEur.Add(m.GainEur)
+
+		if m.Taxable {
+			totals.TaxableGainEur = totals.TaxableGainEur.Add(m.GainEur)
+		}
+
+		byYear[year] = totals
+	}
+
+	return byYear
+}
+
+// Foreign currencies are assets like any other. Disposing them within a year of acquisition results in taxable gains or losses.
+func fxGains(matches []LotMatch) FxGains {
+	entries := []LotMatch{}
+
+	for _, m := range matches {
+		if IsForeignCurrency(m.Asset) {
+			entries = append(entries, m)
+		}
+	}
+
+	return FxGains{
+		Entries: entries,
+		ByYear:  gainsByYear(entries),
+	}
+}
+
+// Split the proceeds of a disposal across the lots that were disposed, proportionally to their units.
+func splitProceeds(disposed time.Time, proceedsEur d.Decimal, entries fifo.EntryList) []LotMatch {
+	matches := []LotMatch{}
+	total := entries.TotalUnitsLeft()
+
+	if total.IsZero() {
+		return matches
+	}
+
+	for _, e := range entries {
+		cost := lotCostEur(fifo.EntryList{e})
+		proceeds := RoundEur(proceedsEur.Mul(e.UnitsLeft).Div(total))
+
+		matches = append(matches, LotMatch{
+			LotID:       e.ID,
+			OriginTxID:  e.OriginTxID,
+			Acquired:    e.Ts,
+			Disposed:    disposed,
+			Units:       e.UnitsLeft,
+			CostEur:     cost,
+			ProceedsEur: proceeds,
+			GainEur:     proceeds.Sub(cost),
+			Taxable:     withinHoldingPeriod(e.Ts, disposed),
+		})
+	}
+
+	return matches
+}
+
+// The holding period ends on the calendar day a year after the acquisition, in German time. A disposal on that
+// day is still within it, regardless of the time of day.
+func withinHoldingPeriod(acquired, disposed time.Time) bool {
+	a := acquired.In(taxLocation)
+	end := time.Date(a.Year()+1, a.Month(), a.Day(), 0, 0, 0, 0, taxLocation)
+
+	t := disposed.In(taxLocation)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, taxLocation)
+
+	return !day.After(end)
+}
@@ -0,0 +1,83 @@
+package reporting
+
+import (
+	"testing"
+	"time"
+
+	"github.com/f-taxes/german_tax_report/proto"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLotMatches(t *testing.T) {
+	units := decimal.RequireFromString
+
+	r := NewGenerator()
+	r.process(propertyTrade("buy-1", time.Date(2023, time.March, 1, 10, 0, 0, 0, time.UTC), "A", proto.TxAction_BUY, units("0.3"), units("20000")))
+	r.process(propertyTrade("buy-2", time.Date(2023, time.June, 1, 10, 0, 0, 0, time.UTC), "A", proto.TxAction_BUY, units("0.7"), units("30000")))
+	r.process(propertyTrade("sell", time.Date(2024, time.April, 1, 10, 0, 0, 0, time.UTC), "A", proto.TxAction_SELL, units("0.8"), units("40000")))
+
+	report := r.Report()
+	require.Len(t, report.Matches, 2)
+
+	// One row for each lot the sale used up, with its share of the proceeds.
+	first, second := report.Matches[0], report.Matches[1]
+
+	assert.Equal(t, "sell", first.RecID)
+	assert.Equal(t, DISPOSAL_CONVERSION, first.Kind)
+	assert.Equal(t, "A", first.Account)
+	assert.Equal(t, "BTC", first.Asset)
+	assert.Equal(t, "buy-1", first.OriginTxID)
+	assert.Equal(t, "0.3", first.Units.String())
+	assert.Equal(t, "6000", first.CostEur.String())
+	assert.Equal(t, "12000", first.ProceedsEur.String())
+	assert.Equal(t, "6000", first.GainEur.String())
+	assert.False(t, first.Taxable)
+
+	assert.Equal(t, "buy-2", second.OriginTxID)
+	assert.Equal(t, "0.5", second.Units.String())
+	assert.Equal(t, "15000", second.CostEur.String())
+	assert.Equal(t, "20000", second.ProceedsEur.String())
+	assert.Equal(t, "5000", second.GainEur.String())
+	assert.True(t, second.Taxable)
+
+	assert.Equal(t, "11000", report.Gains[2024].GainEur.String())
+	assert.Equal(t, "5000", report.Gains[2024].TaxableGainEur.String())
+}
+
+func TestHoldingPeriod(t *testing.T) {
+	tests := []struct {
+		name     string
+		acquired time.Time
+		disposed time.Time
+		taxable  bool
+	}{
+		{"a day before the anniversary", time.Date(2023, time.March, 15, 10, 0, 0, 0, time.UTC), time.Date(2024, time.March, 14, 10, 0, 0, 0, time.UTC), true},
+		{"on the anniversary after the time of acquisition", time.Date(2023, time.March, 15, 10, 0, 0, 0, time.UTC), time.Date(2024, time.March, 15, 22, 0, 0, 0, time.UTC), true},
+		{"on the anniversary in UTC, but the day after in German time", time.Date(2023, time.March, 15, 10, 0, 0, 0, time.UTC), time.Date(2024, time.March, 15, 23, 30, 0, 0, time.UTC), false},
+		{"acquired on new year's eve in UTC, but on new year's day in German time", time.Date(2022, time.December, 31, 23, 30, 0, 0, time.UTC), time.Date(2024, time.January, 1, 10, 0, 0, 0, time.UTC), true},
+		{"the day after the anniversary", time.Date(2022, time.December, 31, 23, 30, 0, 0, time.UTC), time.Date(2024, time.January, 2, 10, 0, 0, 0, time.UTC), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.taxable, withinHoldingPeriod(tt.acquired, tt.disposed))
+		})
+	}
+}
+
+func TestGainsByYear(t *testing.T) {
+	units := decimal.RequireFromString
+
+	r := NewGenerator()
+	r.process(propertyTrade("buy", time.Date(2023, time.June, 1, 10, 0, 0, 0, time.UTC), "A", proto.TxAction_BUY, units("1"), units("20000")))
+	r.process(propertyTrade("sell-2023", time.Date(2023, time.December, 31, 22, 30, 0, 0, time.UTC), "A", proto.TxAction_SELL, units("0.5"), units("30000")))
+	r.process(propertyTrade("sell-2024", time.Date(2023, time.December, 31, 23, 30, 0, 0, time.UTC), "A", proto.TxAction_SELL, units("0.5"), units("24000")))
+
+	// The tax year follows German time, the second sale falls into 2024 even though it's still 2023 in UTC.
+	gains := r.Report().Gains
+	assert.Equal(t, "5000", gains[2023].GainEur.String())
+	assert.Equal(t, "2000", gains[2024].GainEur.String())
+	assert.Equal(t, "2000", gains[2024].TaxableGainEur.String())
+}
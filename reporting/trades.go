@@ -0,0 +1,229 @@
+package reporting
+
+import (
+	"fmt"
+
+	"github.com/f-taxes/german_tax_report/fifo"
+	. "github.com/f-taxes/german_tax_report/global"
+	"github.com/f-taxes/german_tax_report/proto"
+	"github.com/kataras/golog"
+	d "github.com/shopspring/decimal"
+)
+
+// Books spot trades. The acquired asset is added to the account's queue, the disposed one taken from it.
+type tradeHandler struct{}
+
+func (tradeHandler) Handles(rec *proto.Record) bool {
+	return rec.Trade != nil && !rec.Trade.GetProps().GetIsMarginTrade()
+}
+
+func (tradeHandler) Handle(l *Ledger, rec *proto.Record) any {
+	return l.processTrade(rec.Trade)
+}
+
+// Books margin trades into the account's separate margin queues.
+type marginTradeHandler struct{}
+
+func (marginTradeHandler) Handles(rec *proto.Record) bool {
+	return rec.Trade != nil && rec.Trade.GetProps().GetIsMarginTrade()
+}
+
+func (marginTradeHandler) Handle(l *Ledger, rec *proto.Record) any {
+	return l.processMarginTrade(rec.Trade)
+}
+
+func (r *Ledger) processMarginTrade(trade *proto.Trade) (c *Conversion) {
+	c = r.TradeToConversion(trade)
+	key := fmt.Sprintf("%s_%s", c.Account, trade.Ticker)
+
+	acc := r.accounts.Get(c.Account, "margin")
+
+	defer func() {
+		if r.accounts.Get(c.Account).HasUnits(c.To) {
+			c.QueueAfter = append(c.QueueAfter, acc.Snapshot(c.To))
+		}
+
+		if r.accounts.Get(c.Account).HasUnits(c.From) {
+			c.QueueAfter = append(c.QueueAfter, acc.Snapshot(c.From))
+		}
+	}()
+
+	if r.accounts.Get(c.Account).HasUnits(c.To) {
+		c.QueueBefore = append(c.QueueBefore, acc.Snapshot(c.To))
+	}
+
+	if r.accounts.Get(c.Account).HasUnits(c.From) {
+		c.QueueBefore = append(c.QueueBefore, acc.Snapshot(c.From))
+	}
+
+	if acc.HasUnits(c.To) {
+		pastEntries := fifo.EntryList{}
+		isShort := r.marginShortTrades[key]
+
+		if trade.Action == proto.TxAction_BUY {
+			if isShort {
+				pastEntries, err := r.take(c.RecID, c.Account, c.To, c.ToAmount, c.ToDecimals, "margin")
+				c.FromEntries = []fifo.Asset{pastEntries}
+
+				if err != nil {
+					golog.Errorf("Failed to take units for %s out of fifo queue (ID=%s, TS=%s, MARGIN=%v): %v", c.From, trade.TxID, trade.Ts.AsTime(), trade.Props.IsMarginTrade, err)
+					return
+				}
+			} else {
+				acc.Add(c.To, fifo.NewEntry(c.RecID, c.ToAmount, c.FromAmountEur, c.FeeEur, c.Ts))
+			}
+		}
+
+		if trade.Action == proto.TxAction_SELL {
+			if isShort {
+				acc.Add(c.To, fifo.NewEntry(c.RecID, c.ToAmount, c.FromAmountEur, c.FeeEur, c.Ts))
+			} else {
+				pastEntries, err := r.take(c.RecID, c.Account, c.From, c.FromAmount, c.FromDecimals, "margin")
+				c.FromEntries = []fifo.Asset{pastEntries}
+
+				if err != nil {
+					golog.Errorf("Failed to take units for %s out of fifo queue (ID=%s, TS=%s, MARGIN=%v): %v", c.From, trade.TxID, trade.Ts.AsTime(), trade.Props.IsMarginTrade, err)
+					return
+				}
+			}
+		}
+
+		totalCostC := d.Zero
+		// totalCost := d.Zero
+
+		for _, e := range pastEntries {
+			totalCostC = e.UnitCostEur.Mul(e.UnitsLeft).Add(e.UnitFeeCostEur.Mul(e.UnitsLeft))
+			// totalCost = e.UnitCost.Mul(e.UnitsLeft).Add(e.UnitFeeCost.Mul(e.UnitsLeft))
+		}
+
+		c.Result = ConversionResult{
+			CostEur:  totalCostC,
+			ValueEur: c.FromAmountEur.Sub(c.FeeEur),
+			// Pnl: c.FromAmount.Sub(c.Fee).Sub(totalCost),
+			PnlEur:      c.FromAmountEur.Sub(c.FeeEur).Sub(totalCostC),
+			FeePayedEur: c.FeeEur,
+		}
+	} else {
+		if trade.Action == proto.TxAction_SELL {
+			acc.Add(c.From, fifo.NewEntry(c.RecID, c.FromAmount, c.ToAmountEur, c.FeeEur, c.Ts))
+			r.marginShortTrades[key] = true
+		} else {
+			acc.Add(c.To, fifo.NewEntry(c.RecID, c.ToAmount, c.FromAmountEur, c.FeeEur, c.Ts))
+		}
+	}
+
+	// Remove fee from fifo queue.
+	if !c.Fee.IsZero() {
+		_, err := r.take(c.RecID, c.Account, c.FeeCurrency, c.Fee, c.FeeDecimals)
+
+		if err != nil {
+			golog.Errorf("Failed to take units for %s out of fifo queue to pay fees (ID=%s, TS=%s): %v", c.FeeCurrency, trade.TxID, trade.Ts.AsTime(), err)
+		}
+	}
+
+	if !c.QuoteFee.IsZero() {
+		_, err := r.take(c.RecID, c.Account, c.QuoteFeeCurrency, c.QuoteFee, c.QuoteFeeDecimals)
+
+		if err != nil {
+			// fmt.Printf("%s\n", r.accounts.Get(trade.Account).Read("EUR").Entries.Print())
+			golog.Errorf("Failed to take units for %s out of fifo queue to pay fees (ID=%s, TS=%s): %v", c.QuoteFeeCurrency, trade.TxID, trade.Ts.AsTime(), err)
+		}
+	}
+
+	// if c.Result.Pnl != nil {
+
+	// }
+
+	return
+}
+
+func (r *Ledger) processTrade(trade *proto.Trade) (c *Conversion) {
+	c = r.TradeToConversion(trade)
+
+	acc := r.accounts.Get(c.Account)
+
+	defer func() {
+		if acc.HasUnits(c.To) {
+			c.QueueAfter = append(c.QueueAfter, acc.Snapshot(c.To))
+		}
+
+		if acc.HasUnits(c.From) {
+			c.QueueAfter = append(c.QueueAfter, acc.Snapshot(c.From))
+		}
+	}()
+
+	if acc.HasUnits(c.To) {
+		c.QueueBefore = append(c.QueueBefore, acc.Snapshot(c.To))
+	}
+
+	if acc.HasUnits(c.From) {
+		c.QueueBefore = append(c.QueueBefore, acc.Snapshot(c.From))
+	}
+
+	r.add(c.Account, c.To, fifo.NewEntry(c.RecID, c.ToAmount, c.FromAmountEur, c.FeeEur, c.Ts))
+	assetExtracted, err := r.take(c.RecID, c.Account, c.From, c.FromAmount, c.FromDecimals)
+
+	c.FromEntries = []fifo.Asset{assetExtracted}
+
+	if err != nil {
+		ferr := err.(fifo.FifoError)
+		c.Error = fmt.Sprintf("Not enough %s available in FIFO queue. Trying to take %s but queue only holds %s (missing %s).", c.From, ferr.RequiredAmount, D(ferr.RequiredAmount).Sub(D(ferr.MissingAmount)).String(), ferr.MissingAmount)
+		golog.Errorf("Failed to take units for %s out of fifo queue (ID=%s, TS=%s, MARGIN=%v): %v", c.From, trade.TxID, trade.Ts.AsTime(), trade.Props.IsMarginTrade, err)
+	}
+
+	// Remove fee from fifo queue.
+	if !c.Fee.IsZero() {
+		extractedEntries, err := r.take(c.RecID, c.Account, c.FeeCurrency, c.Fee, c.FeeDecimals)
+
+		if err != nil {
+			golog.Errorf("Failed to take units for %s out of fifo queue to pay fees (ID=%s, TS=%s): %v", c.FeeCurrency, trade.TxID, trade.Ts.AsTime(), err)
+		}
+
+		c.FromEntries = append(c.FromEntries, extractedEntries)
+	}
+
+	if !c.QuoteFee.IsZero() {
+		extractedEntries, err := r.take(c.RecID, c.Account, c.QuoteFeeCurrency, c.QuoteFee, c.QuoteFeeDecimals)
+
+		if err != nil {
+			// fmt.Printf("%s\n", r.accounts.Get(trade.Account).Read("EUR").Entries.Print())
+			golog.Errorf("Failed to take units for %s out of fifo queue to pay fees (ID=%s, TS=%s): %v", c.QuoteFeeCurrency, trade.TxID, trade.Ts.AsTime(), err)
+		}
+
+		c.FromEntries = append(c.FromEntries, extractedEntries)
+	}
+
+	totalCostC := lotCostEur(assetExtracted.Entries)
+
+	// fmt.Printf("total cost: %s €\n", totalCostC)
+	// feeC := c.FeeEur
+	// feeC := D(trade.FeeC)
+	// fmt.Printf("selling value: %s €\n", c.FromAmountEur.Sub(c.FeeEur))
+
+	// fmt.Printf("pnl: %s €\n", c.FromAmountEur.Sub(c.FeeEur).Sub(totalCostC))
+	// fmt.Printf("pnl: %s €\n", D(trade.ValueC).Sub(feeC).Sub(totalCostC))
+
+	c.Result = ConversionResult{
+		CostEur:     totalCostC,
+		ValueEur:    RoundEur(c.FromAmountEur.Sub(c.FeeEur)),
+		PnlEur:      RoundEur(c.FromAmountEur.Sub(c.FeeEur).Sub(totalCostC)),
+		FeePayedEur: c.FeeEur,
+	}
+
+	return
+
+	// fmt.Printf("%s\n", r.accounts.Get(trade.Account).Read("EUR").Entries.Print())
+
+	// r.desc.Add(c.Account, convert{Asset: c.To, Quote: c.From, Entries: pastEntries, Ts: c.Ts, Pnl: D(trade.ValueC).Sub(c.FeeEur).Sub(totalCostC).String()})
+	// fifoAssetMap := r.accounts.Get(tx.Account).Get(tx.Asset)
+
+	// if fifoAssetMap.BaseDirectionInverted == BASE_DIR_NONE {
+	// 	fifoAssetMap.BaseDirectionInverted = baseDirFromTxAction(tx.Action)
+	// }
+
+	// if baseDirFromTxAction(tx.Action) == fifoAssetMap.BaseDirectionInverted {
+	// 	fifoAssetMap.Queue.Add(fifo.NewFifoRecord(StrToDecimal(tx.Amount), StrToDecimal(tx.Price), StrToDecimal(tx.Fee)))
+	// } else {
+	// 	fifoAssetMap.Queue.Take(fifo.NewFifoRecord(StrToDecimal(tx.Amount), StrToDecimal(tx.Price), StrToDecimal(tx.Fee)))
+	// }
+}
@@ -0,0 +1,571 @@
+package reporting
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/f-taxes/german_tax_report/fifo"
+	"github.com/f-taxes/german_tax_report/global"
+	. "github.com/f-taxes/german_tax_report/global"
+	"github.com/f-taxes/german_tax_report/proto"
+	"github.com/kataras/golog"
+	d "github.com/shopspring/decimal"
+)
+
+// Maximum time between a withdrawal and a deposit for the two to be considered the same transfer.
+const transferMatchWindow = time.Minute * 15
+
+// Maximum time assets may rest in an intermediate wallet when following a chain of transfers.
+const transferChainWindow = time.Hour * 24 * 30
+
+// Minimum share of a withdrawal's unclaimed units in percent a deposit needs to be matched as one of its parts.
+var minSplitShare = D("10")
+
+// A deposit that couldn't be matched with a withdrawal yet. Exchanges don't always agree on timestamps,
+// so the withdrawal might still show up with a later timestamp.
+type pendingDeposit struct {
+	deposit       *Deposit
+	transfer      *proto.Transfer
+	placeholderID string // Set once the units were released into the queue ahead of the withdrawal.
+}
+
+// Books deposits. They are matched with the withdrawals they came from, to carry over the cost basis.
+type depositHandler struct{}
+
+func (depositHandler) Handles(rec *proto.Record) bool {
+	return rec.Transfer != nil && rec.Transfer.Action == proto.TransferAction_DEPOSIT
+}
+
+// Deposits are added to the report by processDeposit, to keep the report in chronological order.
+func (depositHandler) Handle(l *Ledger, rec *proto.Record) any {
+	l.processDeposit(rec.Transfer)
+	return nil
+}
+
+// Books withdrawals. The units leave the account's queue and wait for a matching deposit.
+type withdrawalHandler struct{}
+
+func (withdrawalHandler) Handles(rec *proto.Record) bool {
+	return rec.Transfer != nil && rec.Transfer.Action == proto.TransferAction_WITHDRAWAL
+}
+
+func (withdrawalHandler) Handle(l *Ledger, rec *proto.Record) any {
+	return l.processWithdrawal(rec.Transfer)
+}
+
+func (r *Ledger) processDeposit(transfer *proto.Transfer) {
+	deposit := &Deposit{
+		RecID:   transfer.TxID,
+		Ts:      transfer.Ts.AsTime(),
+		Type:    "deposit",
+		Asset:   transfer.Asset,
+		Amount:  D(transfer.Amount),
+		Account: transfer.Account,
+		Source:  r.AddressBook.Resolve(transfer.Source),
+		TxHash:  FindTxHash(transfer.TxID, transfer.Comment),
+		Fee:     D(transfer.Fee),
+		FeeEur:  D(transfer.FeeC),
+	}
+
+	// The deposit is added to the report right away to keep the report in chronological order, even if it's booked later.
+	r.Recs = append(r.Recs, deposit)
+
+	if entries, withdrawals := r.findWithdrawals(deposit, transferDecimals(transfer)); withdrawals != nil {
+		r.bookDeposit(deposit, transfer, entries, withdrawals)
+		return
+	}
+
+	// Fiat deposits without a withdrawal are assumed to come from a bank account, unless the withdrawal may still show up.
+	if global.IsFiatCurrency(transfer.Asset) && !r.awaitsWithdrawal(deposit, transfer) {
+		r.bookFiatDeposit(deposit, transfer)
+		return
+	}
+
+	r.pendingDeposits = append(r.pendingDeposits, &pendingDeposit{deposit: deposit, transfer: transfer})
+}
+
+// Whether a withdrawal may still explain the deposit: it's linked to one or another account holds enough to have sent it.
+func (r *Ledger) awaitsWithdrawal(deposit *Deposit, transfer *proto.Transfer) bool {
+	if len(r.Links.LinkedWithdrawals(deposit.RecID)) > 0 {
+		return true
+	}
+
+	for name := range r.accounts {
+		if name != deposit.Account && r.accounts.Get(name).CouldTake(deposit.Asset, deposit.Amount, transferDecimals(transfer)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Book a fiat deposit without a matching withdrawal as a transfer from a bank account.
+func (r *Ledger) bookFiatDeposit(deposit *Deposit, transfer *proto.Transfer) {
+	deposit.QueueBefore = append(deposit.QueueBefore, r.accounts.Get(deposit.Account).Snapshot(deposit.Asset))
+
+	entry := fifo.Entry{
+		ID:          transfer.TxID,
+		OriginTxID:  transfer.TxID,
+		Units:       D(transfer.Amount, d.Zero),
+		UnitsLeft:   D(transfer.Amount, d.Zero),
+		UnitCostEur: D("1"),
+		Ts:          transfer.Ts.AsTime(),
+	}
+
+	deposit.Warning = "No records about how this deposit came do be. Assuming bank account transfer."
+
+	// Deposits in other fiat currencies are valued at the reference rate of the deposit day.
+	if !IsCash(transfer.Asset) {
+		price, day, ok := r.FxRates.EurPrice(transfer.Asset, deposit.Ts)
+
+		if ok {
+			entry.UnitCostEur = price
+			deposit.Warning += fmt.Sprintf(" Valued at the EUR reference rate of %s (1 %s = %s€).", day.Format(time.DateOnly), transfer.Asset, price)
+		} else {
+			entry.UnitCostEur = d.Zero
+			deposit.Warning += fmt.Sprintf(" No EUR reference rate for %s available, so the cost basis is unknown and set to 0€.", transfer.Asset)
+		}
+	}
+
+	deposit.Entries = append(deposit.Entries, entry)
+
+	r.add(transfer.Account, transfer.Asset, entry)
+	r.deductDepositFee(deposit, transfer)
+
+	deposit.QueueAfter = append(deposit.QueueAfter, r.accounts.Get(deposit.Account).Snapshot(deposit.Asset))
+}
+
+// Look for the withdrawals that explain the deposit and claim their assets. Usually this is a single withdrawal, but one
+// withdrawal can also arrive as several deposits and several withdrawals can be combined into one deposit.
+func (r *Ledger) findWithdrawals(deposit *Deposit, decimals int32) (fifo.EntryList, []*Withdrawal) {
+	// Manual links take precedence over any heuristic.
+	if linkedIDs := r.Links.LinkedWithdrawals(deposit.RecID); len(linkedIDs) > 0 {
+		linked := []*Withdrawal{}
+
+		for _, id := range linkedIDs {
+			for _, w := range r.recentWithdrawals {
+				if w.RecID == id {
+					linked = append(linked, w)
+				}
+			}
+		}
+
+		// Wait until all linked withdrawals are known.
+		if len(linked) < len(linkedIDs) {
+			return nil, nil
+		}
+
+		deposit.MatchedBy = "link"
+
+		if len(linked) == 1 {
+			return r.claimWithdrawal(linked[0], deposit.Amount, decimals), linked
+		}
+
+		return r.claimWithdrawals(linked), linked
+	}
+
+	// Equal on-chain hashes of the same asset are a certain match. A transaction may move several assets.
+	if deposit.TxHash != "" {
+		for _, w := range r.recentWithdrawals {
+			if w.TxHash == deposit.TxHash && w.Asset == deposit.Asset && w.unclaimed.IsPositive() && !r.Links.IsLinked(w.RecID) && !r.Links.IsUnlinked(w.RecID, deposit.RecID) {
+				deposit.MatchedBy = "hash"
+				deposit.MatchedHash = w.TxHash
+				return r.claimWithdrawal(w, deposit.Amount, decimals), []*Withdrawal{w}
+			}
+		}
+	}
+
+	direct := []*Withdrawal{}
+	chained := []*Withdrawal{}
+
+	for _, w := range r.recentWithdrawals {
+		if !w.unclaimed.IsPositive() || r.Links.IsLinked(w.RecID) || r.Links.IsUnlinked(w.RecID, deposit.RecID) {
+			continue
+		}
+
+		if w.Asset != deposit.Asset {
+			continue
+		}
+
+		// Time and amount are only considered if at least one side lacks an on-chain hash.
+		if w.TxHash != "" && deposit.TxHash != "" {
+			continue
+		}
+
+		if w.Destination == deposit.Account && w.Ts.Sub(deposit.Ts).Abs() < transferMatchWindow {
+			direct = append(direct, w)
+		}
+
+		// The assets went through a wallet without records of its own, like exchange A -> hardware wallet -> exchange B.
+		if deposit.Source != "" && deposit.Source != deposit.Account && w.Destination == deposit.Source && w.Ts.Before(deposit.Ts) && deposit.Ts.Sub(w.Ts) < transferChainWindow {
+			chained = append(chained, w)
+		}
+	}
+
+	if entries, withdrawals := r.matchWithdrawals(deposit, direct, decimals); withdrawals != nil {
+		deposit.MatchedBy = "heuristic"
+		return entries, withdrawals
+	}
+
+	if entries, withdrawals := r.matchWithdrawals(deposit, chained, decimals); withdrawals != nil {
+		deposit.MatchedBy = "chain"
+		return entries, withdrawals
+	}
+
+	return nil, nil
+}
+
+// Find the withdrawals among the candidates that best explain the deposited amount.
+func (r *Ledger) matchWithdrawals(deposit *Deposit, candidates []*Withdrawal, decimals int32) (fifo.EntryList, []*Withdrawal) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Ts.Before(candidates[j].Ts)
+	})
+
+	// A single withdrawal of roughly the same amount.
+	for _, w := range candidates {
+		if global.PercentageDelta(deposit.Amount, w.unclaimed).LessThan(D("10")) {
+			return r.claimWithdrawal(w, deposit.Amount, decimals), []*Withdrawal{w}
+		}
+	}
+
+	// Several consecutive withdrawals that add up to the deposited amount.
+	for i := range candidates {
+		sum := d.Zero
+
+		for j := i; j < len(candidates); j++ {
+			sum = sum.Add(candidates[j].unclaimed)
+
+			if global.PercentageDelta(deposit.Amount, sum).LessThan(D("10")) {
+				merged := append([]*Withdrawal{}, candidates[i:j+1]...)
+				return r.claimWithdrawals(merged), merged
+			}
+
+			if sum.GreaterThan(deposit.Amount) {
+				break
+			}
+		}
+	}
+
+	// A larger withdrawal that was split into several deposits. Tiny deposits are more likely unrelated than a part of it.
+	for _, w := range candidates {
+		if w.unclaimed.GreaterThan(deposit.Amount) && deposit.Amount.Mul(D("100")).Div(w.unclaimed).GreaterThanOrEqual(minSplitShare) {
+			return r.claimWithdrawal(w, deposit.Amount, decimals), []*Withdrawal{w}
+		}
+	}
+
+	return nil, nil
+}
+
+// Claim the given amount of units from the withdrawal. If the amount is about what is left of the withdrawal, all of its
+// remaining lots are claimed. Otherwise each lot is split proportionally and the withdrawal waits for further deposits.
+func (r *Ledger) claimWithdrawal(w *Withdrawal, units d.Decimal, decimals int32) fifo.EntryList {
+	if units.GreaterThanOrEqual(w.unclaimed) || global.PercentageDelta(units, w.unclaimed).LessThan(D("10")) {
+		return r.claimWithdrawals([]*Withdrawal{w})
+	}
+
+	claimed, rest := w.remaining.Split(units.Div(w.unclaimed), decimals)
+	w.remaining = rest
+	w.unclaimed = w.unclaimed.Sub(units)
+
+	return claimed
+}
+
+// Claim everything that is left of the withdrawals and remove them from the list of recent withdrawals.
+func (r *Ledger) claimWithdrawals(withdrawals []*Withdrawal) fifo.EntryList {
+	claimed := fifo.EntryList{}
+
+	for _, w := range withdrawals {
+		claimed = append(claimed, w.remaining...)
+		w.remaining = fifo.EntryList{}
+		w.unclaimed = d.Zero
+
+		for i := range r.recentWithdrawals {
+			if r.recentWithdrawals[i] == w {
+				r.recentWithdrawals = global.RemoveElementUnordered(r.recentWithdrawals, i)
+				break
+			}
+		}
+	}
+
+	return claimed
+}
+
+// Move the withdrawn assets into the fifo queue of the account that received them.
+func (r *Ledger) bookDeposit(deposit *Deposit, transfer *proto.Transfer, entries fifo.EntryList, withdrawals []*Withdrawal) {
+	deposit.QueueBefore = append(deposit.QueueBefore, r.accounts.Get(deposit.Account).Snapshot(deposit.Asset))
+	deposit.Entries = entries
+
+	for _, w := range withdrawals {
+		deposit.Withdrawals = append(deposit.Withdrawals, w.RecID)
+
+		if deposit.RecID != "" {
+			w.Deposits = append(w.Deposits, deposit.RecID)
+		}
+
+		if w.Ts.After(deposit.Ts) {
+			deposit.Warning = joinMessages(deposit.Warning, fmt.Sprintf("Deposit is recorded before its withdrawal %s and was booked when the withdrawal occurred.", w.RecID))
+		}
+	}
+
+	for _, e := range deposit.Entries {
+		r.add(transfer.Account, transfer.Asset, e.Copy())
+	}
+
+	r.deductDepositFee(deposit, transfer)
+
+	deposit.QueueAfter = append(deposit.QueueAfter, r.accounts.Get(deposit.Account).Snapshot(deposit.Asset))
+}
+
+func (r *Ledger) deductDepositFee(deposit *Deposit, transfer *proto.Transfer) {
+	if D(transfer.Fee).GreaterThan(d.Zero) {
+		feeAssets, err := r.take(deposit.RecID, transfer.Account, transfer.FeeCurrency, D(transfer.Fee), transfer.FeeDecimals)
+		if err != nil {
+			golog.Errorf("Failed to withdraw %s %s from %s: %v", transfer.Amount, transfer.Asset, transfer.Account, err)
+		}
+
+		deposit.Entries = append(deposit.Entries, feeAssets.Entries...)
+	}
+}
+
+// Try to book deposits that arrived before their withdrawal.
+func (r *Ledger) matchPendingDeposits() {
+	pending := []*pendingDeposit{}
+
+	for _, p := range r.pendingDeposits {
+		if entries, withdrawals := r.findWithdrawals(p.deposit, transferDecimals(p.transfer)); withdrawals != nil {
+			r.bookDeposit(p.deposit, p.transfer, entries, withdrawals)
+			continue
+		}
+
+		pending = append(pending, p)
+	}
+
+	r.pendingDeposits = pending
+}
+
+// Book the fiat deposits of the account still waiting for their withdrawal, as long as the account can't cover the
+// units it has to give. Spending the deposit means it didn't come from a withdrawal recorded later on.
+func (r *Ledger) bookPendingFiatDeposits(account, asset string, units d.Decimal, decimals int32) {
+	pending := []*pendingDeposit{}
+
+	for _, p := range r.pendingDeposits {
+		deposit := p.deposit
+
+		if deposit.Account != account || deposit.Asset != asset || len(r.Links.LinkedWithdrawals(deposit.RecID)) > 0 || r.accounts.Get(account).CouldTake(asset, units, decimals) {
+			pending = append(pending, p)
+			continue
+		}
+
+		r.bookFiatDeposit(deposit, p.transfer)
+	}
+
+	r.pendingDeposits = pending
+}
+
+// Release the crypto deposits of the account still waiting for their withdrawal into its queue, as long as the account
+// can't cover the units it has to give. The units stand in as a placeholder lot, which the withdrawn lots settle once
+// the withdrawal shows up, so spending them doesn't fall short.
+func (r *Ledger) releasePendingDeposits(account, asset string, units d.Decimal, decimals int32) {
+	for _, p := range r.pendingDeposits {
+		deposit := p.deposit
+
+		if deposit.Account != account || deposit.Asset != asset || p.placeholderID != "" || r.accounts.Get(account).CouldTake(asset, units, decimals) {
+			continue
+		}
+
+		// The placeholder is registered after its lot was added, so the lot doesn't settle it right away.
+		ph := newPlaceholder(deposit.RecID+"/pending", deposit.RecID, account, asset, deposit.Amount)
+		r.add(account, asset, ph.lot(deposit.Ts))
+		r.placeholders = append(r.placeholders, ph)
+
+		p.placeholderID = ph.ID
+		deposit.Warning = joinMessages(deposit.Warning, "Deposit was spent before its withdrawal was recorded. Its units were released ahead of the withdrawal, which provides their cost basis.")
+	}
+}
+
+// Give up on deposits that waited longer than the matching window for their withdrawal.
+// A zero time expires all pending deposits, which is done once all records are processed.
+func (r *Ledger) expirePendingDeposits(now time.Time) {
+	pending := []*pendingDeposit{}
+
+	for _, p := range r.pendingDeposits {
+		if !now.IsZero() && now.Sub(p.deposit.Ts) <= transferMatchWindow {
+			pending = append(pending, p)
+			continue
+		}
+
+		if r.inferHopWithdrawal(p) {
+			continue
+		}
+
+		deposit := p.deposit
+
+		if global.IsFiatCurrency(deposit.Asset) && len(r.Links.LinkedWithdrawals(deposit.RecID)) == 0 {
+			r.bookFiatDeposit(deposit, p.transfer)
+			continue
+		}
+
+		deposit.QueueBefore = append(deposit.QueueBefore, r.accounts.Get(deposit.Account).Snapshot(deposit.Asset))
+		deposit.QueueAfter = append(deposit.QueueAfter, r.accounts.Get(deposit.Account).Snapshot(deposit.Asset))
+
+		if linkedIDs := r.Links.LinkedWithdrawals(deposit.RecID); len(linkedIDs) > 0 {
+			deposit.Error = fmt.Sprintf("Deposit is linked to withdrawal %s, but that withdrawal was not found or is already booked.", strings.Join(linkedIDs, ", "))
+		} else {
+			deposit.Error = "No prior withdrawal found to explain how this deposit was possible."
+		}
+	}
+
+	r.pendingDeposits = pending
+}
+
+// If the deposit names one of our accounts as source, but that account has no record of the withdrawal,
+// take the assets directly out of the source account's queue.
+func (r *Ledger) inferHopWithdrawal(p *pendingDeposit) bool {
+	deposit := p.deposit
+
+	if deposit.Source == "" || deposit.Source == deposit.Account {
+		return false
+	}
+
+	if _, ok := r.accounts[deposit.Source]; !ok {
+		return false
+	}
+
+	source := r.accounts.Get(deposit.Source)
+
+	if !source.CouldTake(deposit.Asset, deposit.Amount, transferDecimals(p.transfer)) {
+		return false
+	}
+
+	asset, err := r.take(deposit.RecID, deposit.Source, deposit.Asset, deposit.Amount, transferDecimals(p.transfer))
+	if err != nil {
+		golog.Errorf("Failed to withdraw %s %s from %s: %v", deposit.Amount, deposit.Asset, deposit.Source, err)
+		return false
+	}
+
+	deposit.MatchedBy = "inferred"
+	r.bookDeposit(deposit, p.transfer, asset.Entries, nil)
+	deposit.Warning = fmt.Sprintf("No withdrawal recorded in %s. Assuming the assets were moved from there.", deposit.Source)
+
+	return true
+}
+
+// If an account has to withdraw more than it holds, look for withdrawals that were sent to this account but never
+// showed up as deposit. These are booked as deposit first, so that assets can be followed through the account.
+func (r *Ledger) inferHopDeposits(transfer *proto.Transfer) {
+	acc := r.accounts.Get(transfer.Account)
+
+	for _, w := range r.recentWithdrawals {
+		if acc.CouldTake(transfer.Asset, D(transfer.Amount), transferDecimals(transfer)) {
+			return
+		}
+
+		if w.Destination != transfer.Account || w.Asset != transfer.Asset || !w.unclaimed.IsPositive() || r.Links.IsLinked(w.RecID) {
+			continue
+		}
+
+		if w.Ts.After(transfer.Ts.AsTime()) || transfer.Ts.AsTime().Sub(w.Ts) > transferChainWindow {
+			continue
+		}
+
+		r.bookInferredDeposit(w, transfer.Ts.AsTime())
+
+		// Claiming removed the withdrawal from the list, so start over.
+		r.inferHopDeposits(transfer)
+		return
+	}
+}
+
+// Withdrawals to addresses from the address book are moved into the queue of the wallet's account,
+// if no deposit showed up for them within the matching window.
+// A zero time books all of them, which is done once all records are processed.
+func (r *Ledger) bookOwnWalletWithdrawals(now time.Time) {
+	for _, w := range append([]*Withdrawal{}, r.recentWithdrawals...) {
+		if !w.toOwnWallet || !w.unclaimed.IsPositive() || r.Links.IsLinked(w.RecID) {
+			continue
+		}
+
+		if now.IsZero() || now.Sub(w.Ts) > transferMatchWindow {
+			r.bookInferredDeposit(w, w.Ts)
+		}
+	}
+}
+
+// Book what is left of the withdrawal as deposit into its destination account, for which no deposit was recorded.
+func (r *Ledger) bookInferredDeposit(w *Withdrawal, ts time.Time) {
+	deposit := &Deposit{
+		Ts:        ts,
+		Type:      "deposit",
+		Asset:     w.Asset,
+		Amount:    w.unclaimed,
+		Account:   w.Destination,
+		Source:    w.Account,
+		MatchedBy: "inferred",
+	}
+
+	r.Recs = append(r.Recs, deposit)
+	r.bookDeposit(deposit, &proto.Transfer{Account: w.Destination, Asset: w.Asset}, r.claimWithdrawals([]*Withdrawal{w}), []*Withdrawal{w})
+	deposit.Warning = fmt.Sprintf("No deposit recorded for withdrawal %s. Assuming it arrived in %s.", w.RecID, w.Destination)
+}
+
+// Number of decimals the transferred asset is rounded to.
+func transferDecimals(transfer *proto.Transfer) int32 {
+	return Precision.UnitDecimals(transfer.Asset, transfer.AssetDecimals)
+}
+
+func (r *Ledger) processWithdrawal(transfer *proto.Transfer) (w *Withdrawal) {
+	w = &Withdrawal{
+		RecID:       transfer.TxID,
+		Ts:          transfer.Ts.AsTime(),
+		Type:        "withdrawal",
+		Account:     transfer.Account,
+		Asset:       transfer.Asset,
+		Amount:      D(transfer.Amount),
+		Destination: transfer.Destination,
+		TxHash:      FindTxHash(transfer.TxID, transfer.Comment),
+		Fee:         D(transfer.Fee),
+		FeeEur:      D(transfer.FeeC),
+	}
+
+	if account, ok := r.AddressBook.Account(transfer.Destination); ok {
+		w.Destination = account
+		w.Address = transfer.Destination
+		w.toOwnWallet = true
+	} else if LooksLikeAddress(transfer.Destination) {
+		w.NeedsClassification = true
+		w.Warning = fmt.Sprintf("Withdrawal to %s, which is not in the address book. Add the address if it belongs to one of your wallets, otherwise the withdrawal needs to be classified.", transfer.Destination)
+	}
+
+	defer func() {
+		w.QueueAfter = append(w.QueueAfter, r.accounts.Get(w.Account).Snapshot(w.Asset))
+	}()
+
+	r.inferHopDeposits(transfer)
+
+	w.QueueBefore = append(w.QueueBefore, r.accounts.Get(w.Account).Snapshot(w.Asset))
+
+	asset, err := r.take(w.RecID, transfer.Account, transfer.Asset, D(transfer.Amount), transfer.AssetDecimals)
+	if err != nil {
+		golog.Errorf("Failed to withdraw %s %s from %s: %v", transfer.Amount, transfer.Asset, transfer.Account, err)
+	}
+
+	if D(transfer.Fee).GreaterThan(d.Zero) {
+		feeAssets, err := r.take(w.RecID, transfer.Account, transfer.FeeCurrency, D(transfer.Fee), transfer.FeeDecimals)
+		if err != nil {
+			golog.Errorf("Failed to withdraw %s %s from %s: %v", transfer.Amount, transfer.Asset, transfer.Account, err)
+		}
+
+		asset.Entries = append(asset.Entries, feeAssets.Entries...)
+	}
+
+	w.Entries = asset.Entries
+	w.remaining = asset.Entries.Copy()
+	w.unclaimed = w.Amount
+
+	r.recentWithdrawals = append(r.recentWithdrawals, w)
+	r.matchPendingDeposits()
+
+	return
+}
@@ -0,0 +1,376 @@
+package reporting
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/f-taxes/german_tax_report/fifo"
+	"github.com/f-taxes/german_tax_report/proto"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var transferStart = time.Date(2024, time.January, 20, 15, 0, 0, 0, time.UTC)
+
+func withdrawalRec(id string, minute int, account, destination, asset, amount string) *proto.Record {
+	return &proto.Record{Transfer: &proto.Transfer{TxID: id, Ts: timestamppb.New(transferStart.Add(time.Duration(minute) * time.Minute)), Account: account, Destination: destination, Asset: asset, Amount: amount, AssetDecimals: 8, Action: proto.TransferAction_WITHDRAWAL}}
+}
+
+func depositRec(id string, minute int, account, asset, amount string) *proto.Record {
+	return &proto.Record{Transfer: &proto.Transfer{TxID: id, Ts: timestamppb.New(transferStart.Add(time.Duration(minute) * time.Minute)), Account: account, Asset: asset, Amount: amount, AssetDecimals: 8, Action: proto.TransferAction_DEPOSIT}}
+}
+
+// A generator whose account A holds the given units of each asset, bought at 1€ each an hour before the transfers.
+func fundedGenerator(holdings map[string]string) *Generator {
+	r := NewGenerator()
+
+	for asset, units := range holdings {
+		r.accounts.Get("A").Add(asset, fifo.NewEntry("open-"+asset, decimal.RequireFromString(units), decimal.RequireFromString(units), decimal.Zero, transferStart.Add(-time.Hour)))
+	}
+
+	return r
+}
+
+// Add an on-chain hash to a transfer record, the way exchanges export it in the comment.
+func withHash(rec *proto.Record, hash string) *proto.Record {
+	rec.Transfer.Comment = "tx: " + hash
+	return rec
+}
+
+// Name the account a deposit came from.
+func fromSource(rec *proto.Record, source string) *proto.Record {
+	rec.Transfer.Source = source
+	return rec
+}
+
+func deposits(r *Generator) map[string]*Deposit {
+	out := map[string]*Deposit{}
+
+	for _, rec := range r.Recs {
+		if d, ok := rec.(*Deposit); ok {
+			out[d.RecID] = d
+		}
+	}
+
+	return out
+}
+
+func TestTransferMatching(t *testing.T) {
+	t.Run("one withdrawal split into several deposits", func(t *testing.T) {
+		r := fundedGenerator(map[string]string{"BTC": "1"})
+		r.process(withdrawalRec("w1", 0, "A", "B", "BTC", "1"))
+		r.process(depositRec("d1", 2, "B", "BTC", "0.6"))
+		r.process(depositRec("d2", 3, "B", "BTC", "0.4"))
+
+		dep := deposits(r)
+		assert.Equal(t, []string{"w1"}, dep["d1"].Withdrawals)
+		assert.Equal(t, []string{"w1"}, dep["d2"].Withdrawals)
+		assert.Equal(t, "heuristic", dep["d1"].MatchedBy)
+		assert.Empty(t, dep["d1"].MatchedHash)
+		assert.Equal(t, "1", r.accounts.Get("B").Read("BTC").Total)
+		assert.Equal(t, "1", lotCostEur(r.accounts.Get("B").Read("BTC").Entries).String())
+	})
+
+	t.Run("several withdrawals merged into one deposit", func(t *testing.T) {
+		r := fundedGenerator(map[string]string{"BTC": "1"})
+		r.process(withdrawalRec("w1", 0, "A", "B", "BTC", "0.3"))
+		r.process(withdrawalRec("w2", 1, "A", "B", "BTC", "0.7"))
+		r.process(depositRec("d1", 3, "B", "BTC", "1"))
+
+		assert.Equal(t, []string{"w1", "w2"}, deposits(r)["d1"].Withdrawals)
+		assert.Equal(t, "1", r.accounts.Get("B").Read("BTC").Total)
+	})
+
+	t.Run("deposits of other assets in the same window", func(t *testing.T) {
+		r := fundedGenerator(map[string]string{"USDT": "1000", "ETH": "1"})
+		r.process(withdrawalRec("w1", 0, "A", "B", "USDT", "1000"))
+		r.process(withdrawalRec("w2", 1, "A", "B", "ETH", "1"))
+		r.process(depositRec("d1", 2, "B", "ETH", "1"))
+		r.process(depositRec("d2", 3, "B", "USDT", "1000"))
+
+		dep := deposits(r)
+		assert.Equal(t, []string{"w2"}, dep["d1"].Withdrawals)
+		assert.Equal(t, []string{"w1"}, dep["d2"].Withdrawals)
+		assert.Equal(t, "1", r.accounts.Get("B").Read("ETH").Total)
+		assert.Equal(t, "1000", r.accounts.Get("B").Read("USDT").Total)
+	})
+
+	t.Run("unrelated deposit of another asset", func(t *testing.T) {
+		r := fundedGenerator(map[string]string{"USDT": "1000"})
+		r.process(withdrawalRec("w1", 0, "A", "B", "USDT", "1000"))
+		r.process(depositRec("d1", 2, "B", "ETH", "1"))
+		r.process(depositRec("d2", 3, "B", "USDT", "1000"))
+
+		dep := deposits(r)
+		assert.Empty(t, dep["d1"].Withdrawals)
+		assert.False(t, r.accounts.Get("B").HasUnits("ETH"))
+		assert.Equal(t, []string{"w1"}, dep["d2"].Withdrawals)
+		assert.Equal(t, "1000", r.accounts.Get("B").Read("USDT").Total)
+	})
+
+	t.Run("tiny deposit isn't a part of a large withdrawal", func(t *testing.T) {
+		r := fundedGenerator(map[string]string{"USDT": "1000"})
+		r.process(withdrawalRec("w1", 0, "A", "B", "USDT", "1000"))
+		r.process(depositRec("d1", 2, "B", "USDT", "1"))
+		r.process(depositRec("d2", 3, "B", "USDT", "1000"))
+
+		dep := deposits(r)
+		assert.Empty(t, dep["d1"].Withdrawals)
+		assert.Equal(t, []string{"w1"}, dep["d2"].Withdrawals)
+		assert.Equal(t, "1000", r.accounts.Get("B").Read("USDT").Total)
+	})
+
+	hash := strings.Repeat("ab", 32)
+
+	t.Run("same on-chain hash", func(t *testing.T) {
+		r := fundedGenerator(map[string]string{"BTC": "1"})
+		// The destination is an address, so only the hash can tell where the units went.
+		r.process(withHash(withdrawalRec("w1", 0, "A", "bc1qxy2kgdygjrsqtzq2n0yrf2493p83kkfjhx0wlh", "BTC", "1"), hash))
+		r.process(withHash(depositRec("d1", 40, "B", "BTC", "1"), "0x"+strings.ToUpper(hash)))
+
+		dep := deposits(r)["d1"]
+		assert.Equal(t, []string{"w1"}, dep.Withdrawals)
+		assert.Equal(t, "hash", dep.MatchedBy)
+		assert.Equal(t, hash, dep.MatchedHash)
+		assert.Equal(t, "1", r.accounts.Get("B").Read("BTC").Total)
+	})
+
+	t.Run("on-chain hash shared by several assets", func(t *testing.T) {
+		r := fundedGenerator(map[string]string{"ETH": "1", "USDT": "1000"})
+		r.process(withHash(withdrawalRec("w1", 0, "A", "B", "ETH", "1"), hash))
+		r.process(withHash(withdrawalRec("w2", 0, "A", "B", "USDT", "1000"), hash))
+		r.process(withHash(depositRec("d1", 2, "B", "USDT", "1000"), hash))
+		r.process(withHash(depositRec("d2", 3, "B", "ETH", "1"), hash))
+
+		dep := deposits(r)
+		assert.Equal(t, []string{"w2"}, dep["d1"].Withdrawals)
+		assert.Equal(t, "hash", dep["d1"].MatchedBy)
+		assert.Equal(t, []string{"w1"}, dep["d2"].Withdrawals)
+		assert.Equal(t, "hash", dep["d2"].MatchedBy)
+		assert.Equal(t, "1000", r.accounts.Get("B").Read("USDT").Total)
+		assert.Equal(t, "1", r.accounts.Get("B").Read("ETH").Total)
+	})
+
+	t.Run("different on-chain hashes", func(t *testing.T) {
+		r := fundedGenerator(map[string]string{"BTC": "1"})
+		r.process(withHash(withdrawalRec("w1", 0, "A", "B", "BTC", "1"), hash))
+		r.process(withHash(depositRec("d1", 2, "B", "BTC", "1"), strings.Repeat("cd", 32)))
+
+		dep := deposits(r)["d1"]
+		assert.Empty(t, dep.Withdrawals)
+		assert.Empty(t, dep.MatchedBy)
+		assert.False(t, r.accounts.Get("B").HasUnits("BTC"))
+	})
+}
+
+func TestTransferChains(t *testing.T) {
+	assertOrigin := func(t *testing.T, r *Generator, account string) {
+		lots := r.accounts.Get(account).Read("BTC").Entries
+		assert.Len(t, lots, 1)
+		assert.Equal(t, "open-BTC", lots[0].OriginTxID)
+		assert.Equal(t, transferStart.Add(-time.Hour), lots[0].Ts)
+	}
+
+	t.Run("through a wallet without records", func(t *testing.T) {
+		r := fundedGenerator(map[string]string{"BTC": "1"})
+		r.process(withdrawalRec("w1", 0, "A", "Ledger", "BTC", "1"))
+		r.process(fromSource(depositRec("d1", 24*60, "B", "BTC", "1"), "Ledger"))
+
+		dep := deposits(r)["d1"]
+		assert.Equal(t, []string{"w1"}, dep.Withdrawals)
+		assert.Equal(t, "chain", dep.MatchedBy)
+		assertOrigin(t, r, "B")
+	})
+
+	t.Run("hop with only a deposit record", func(t *testing.T) {
+		r := fundedGenerator(map[string]string{"BTC": "1"})
+		runFrom(r, []*proto.Record{fromSource(depositRec("d1", 0, "B", "BTC", "1"), "A")}, time.Time{})
+
+		dep := deposits(r)["d1"]
+		assert.Empty(t, dep.Error)
+		assert.Equal(t, "inferred", dep.MatchedBy)
+		assert.Contains(t, dep.Warning, "No withdrawal recorded in A")
+		assert.False(t, r.accounts.Get("A").HasUnits("BTC"))
+		assertOrigin(t, r, "B")
+	})
+
+	t.Run("hop with only a withdrawal record", func(t *testing.T) {
+		r := fundedGenerator(map[string]string{"BTC": "1"})
+		r.process(withdrawalRec("w1", 0, "A", "W", "BTC", "1"))
+		r.process(withdrawalRec("w2", 60, "W", "B", "BTC", "1"))
+		r.process(depositRec("d2", 62, "B", "BTC", "1"))
+
+		// The deposit into the intermediate wallet is inferred, so its withdrawal has something to send.
+		var inferred *Deposit
+		for _, rec := range r.Recs {
+			if d, ok := rec.(*Deposit); ok && d.Account == "W" {
+				inferred = d
+			}
+		}
+
+		if assert.NotNil(t, inferred) {
+			assert.Equal(t, []string{"w1"}, inferred.Withdrawals)
+			assert.Equal(t, "inferred", inferred.MatchedBy)
+		}
+
+		assert.Equal(t, []string{"w2"}, deposits(r)["d2"].Withdrawals)
+		assert.False(t, r.accounts.Get("W").HasUnits("BTC"))
+		assertOrigin(t, r, "B")
+	})
+}
+
+func TestAddressBook(t *testing.T) {
+	const address = "bc1qxy2kgdygjrsqtzq2n0yrf2493p83kkfjhx0wlh"
+
+	ownWallet := func() *Generator {
+		r := fundedGenerator(map[string]string{"BTC": "1"})
+		r.AddressBook = NewAddressBook(map[string]string{address: "Ledger"})
+		return r
+	}
+
+	t.Run("withdrawal to a known address without a deposit", func(t *testing.T) {
+		r := ownWallet()
+		runFrom(r, []*proto.Record{withdrawalRec("w1", 0, "A", strings.ToUpper(address), "BTC", "1")}, time.Time{})
+
+		w := withdrawal(r, "w1")
+		assert.Equal(t, "Ledger", w.Destination)
+		assert.Equal(t, strings.ToUpper(address), w.Address)
+		assert.False(t, w.NeedsClassification)
+		assert.Equal(t, []string{"w1"}, deposits(r)[""].Withdrawals)
+		assert.Contains(t, deposits(r)[""].Warning, "Assuming it arrived in Ledger")
+
+		lots := r.accounts.Get("Ledger").Read("BTC").Entries
+		assert.Len(t, lots, 1)
+		assert.Equal(t, "open-BTC", lots[0].OriginTxID)
+	})
+
+	t.Run("withdrawal to a known address with a deposit", func(t *testing.T) {
+		r := ownWallet()
+		runFrom(r, []*proto.Record{
+			withdrawalRec("w1", 0, "A", address, "BTC", "1"),
+			depositRec("d1", 5, "Ledger", "BTC", "1"),
+		}, time.Time{})
+
+		assert.Equal(t, []string{"w1"}, deposits(r)["d1"].Withdrawals)
+		assert.NotContains(t, deposits(r), "")
+		assert.Equal(t, "1", r.accounts.Get("Ledger").Read("BTC").Total)
+	})
+
+	t.Run("withdrawal to an unknown address", func(t *testing.T) {
+		r := ownWallet()
+		runFrom(r, []*proto.Record{withdrawalRec("w1", 0, "A", "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq", "BTC", "1")}, time.Time{})
+
+		w := withdrawal(r, "w1")
+		assert.True(t, w.NeedsClassification)
+		assert.Contains(t, w.Warning, "not in the address book")
+		assert.Empty(t, deposits(r))
+		assert.False(t, r.accounts.Get("Ledger").HasUnits("BTC"))
+	})
+}
+
+func TestPendingDeposits(t *testing.T) {
+	t.Run("deposit spent before its withdrawal is recorded", func(t *testing.T) {
+		r := fundedGenerator(map[string]string{"BTC": "1"})
+		runFrom(r, []*proto.Record{
+			depositRec("d1", 0, "B", "BTC", "1"),
+			propertyTrade("sell", transferStart.Add(2*time.Minute), "B", proto.TxAction_SELL, decimal.RequireFromString("0.4"), decimal.RequireFromString("40000")),
+			withdrawalRec("w1", 3, "A", "B", "BTC", "1"),
+			propertyTrade("sell-rest", transferStart.Add(4*time.Minute), "B", proto.TxAction_SELL, decimal.RequireFromString("0.6"), decimal.RequireFromString("40000")),
+		}, time.Time{})
+
+		dep := deposits(r)["d1"]
+		assert.Equal(t, []string{"w1"}, dep.Withdrawals)
+		assert.Empty(t, dep.Error)
+		assert.Contains(t, dep.Warning, "spent before its withdrawal")
+
+		// Both sales use the lots of the withdrawal, whether they were settled later or were in the queue already.
+		for id, cost := range map[string]string{"sell": "0.4", "sell-rest": "0.6"} {
+			c := conversion(r, id)
+			assert.Empty(t, c.Error, id)
+			assert.Equal(t, cost, c.Result.CostEur.String(), id)
+			assert.Equal(t, []string{"open-BTC"}, originsOf(c), id)
+		}
+
+		assert.False(t, r.accounts.Get("A").HasUnits("BTC"))
+		assert.False(t, r.accounts.Get("B").HasUnits("BTC"))
+	})
+
+	t.Run("deposit not needed yet stays pending", func(t *testing.T) {
+		r := fundedGenerator(map[string]string{"BTC": "1"})
+		r.accounts.Get("B").Add("BTC", fifo.NewEntry("open-B", decimal.RequireFromString("1"), decimal.RequireFromString("1"), decimal.Zero, transferStart.Add(-time.Hour)))
+		r.process(depositRec("d1", 0, "B", "BTC", "1"))
+		r.process(propertyTrade("sell", transferStart.Add(2*time.Minute), "B", proto.TxAction_SELL, decimal.RequireFromString("0.4"), decimal.RequireFromString("40000")))
+
+		assert.Len(t, r.pendingDeposits, 1)
+		assert.Empty(t, r.placeholders)
+		assert.Equal(t, "0.6", r.accounts.Get("B").Read("BTC").Total)
+	})
+}
+
+func TestFiatDeposits(t *testing.T) {
+	t.Run("deposit without another account holding the currency", func(t *testing.T) {
+		r := NewGenerator()
+		r.process(depositRec("d1", 0, "B", "EUR", "500"))
+
+		assert.Empty(t, r.pendingDeposits)
+		assert.Equal(t, "500", r.accounts.Get("B").Read("EUR").Total)
+		assert.Contains(t, deposits(r)["d1"].Warning, "Assuming bank account transfer")
+	})
+
+	t.Run("deposit recorded before its withdrawal", func(t *testing.T) {
+		r := fundedGenerator(map[string]string{"EUR": "1000"})
+		r.process(depositRec("d1", 0, "B", "EUR", "500"))
+		assert.Len(t, r.pendingDeposits, 1)
+
+		r.process(withdrawalRec("w1", 3, "A", "B", "EUR", "500"))
+
+		dep := deposits(r)["d1"]
+		assert.Equal(t, []string{"w1"}, dep.Withdrawals)
+		assert.Equal(t, "heuristic", dep.MatchedBy)
+		assert.Contains(t, dep.Warning, "recorded before its withdrawal")
+		assert.Empty(t, r.pendingDeposits)
+		assert.Equal(t, "500", r.accounts.Get("A").Read("EUR").Total)
+		assert.Equal(t, "500", r.accounts.Get("B").Read("EUR").Total)
+	})
+
+	t.Run("linked deposit waits for its withdrawal", func(t *testing.T) {
+		r := NewGenerator()
+		r.Links = TransferLinks{{Withdrawal: "w1", Deposit: "d1"}}
+		r.process(depositRec("d1", 0, "B", "EUR", "500"))
+		assert.Len(t, r.pendingDeposits, 1)
+		assert.False(t, r.accounts.Get("B").HasUnits("EUR"))
+
+		r.accounts.Get("A").Add("EUR", fifo.NewEntry("open-EUR", decimal.RequireFromString("500"), decimal.RequireFromString("500"), decimal.Zero, transferStart.Add(-time.Hour)))
+		r.process(withdrawalRec("w1", 10, "A", "B", "EUR", "500"))
+
+		dep := deposits(r)["d1"]
+		assert.Equal(t, []string{"w1"}, dep.Withdrawals)
+		assert.Equal(t, "link", dep.MatchedBy)
+		assert.Equal(t, "500", r.accounts.Get("B").Read("EUR").Total)
+	})
+
+	t.Run("deposit without a withdrawal is booked once the window passed", func(t *testing.T) {
+		r := fundedGenerator(map[string]string{"EUR": "1000"})
+		r.process(depositRec("d1", 0, "B", "EUR", "500"))
+		r.process(depositRec("d2", 30, "C", "BTC", "1"))
+
+		dep := deposits(r)["d1"]
+		assert.Empty(t, dep.Withdrawals)
+		assert.Empty(t, dep.Error)
+		assert.Contains(t, dep.Warning, "Assuming bank account transfer")
+		assert.Equal(t, "500", r.accounts.Get("B").Read("EUR").Total)
+	})
+
+	t.Run("deposit spent before the window passed", func(t *testing.T) {
+		r := fundedGenerator(map[string]string{"EUR": "1000"})
+		r.process(depositRec("d1", 0, "B", "EUR", "500"))
+		r.process(propertyTrade("t1", transferStart.Add(2*time.Minute), "B", proto.TxAction_BUY, decimal.RequireFromString("0.01"), decimal.RequireFromString("20000")))
+
+		assert.Empty(t, r.pendingDeposits)
+		assert.Contains(t, deposits(r)["d1"].Warning, "Assuming bank account transfer")
+		assert.Equal(t, "300", r.accounts.Get("B").Read("EUR").Total)
+		assert.Equal(t, "0.01", r.accounts.Get("B").Read("BTC").Total)
+	})
+}
@@ -11,6 +11,7 @@ import (
 )
 
 type Deposit struct {
+	RecID       string
 	Ts          time.Time
 	Type        string
 	Account     string
@@ -19,28 +20,41 @@ type Deposit struct {
 	Fee         decimal.Decimal
 	FeeEur      decimal.Decimal
 	Source      string
+	TxHash      string   // On-chain transaction hash, if the exchange exported one.
+	MatchedHash string   // The on-chain hash that linked this deposit to its withdrawal.
+	Withdrawals []string // RecIDs of the withdrawals this deposit was matched with.
+	MatchedBy   string   // How the withdrawal was found. One of "link" (manual link), "hash" (same on-chain hash), "heuristic", "chain" (through a wallet without records) or "inferred" (a hop without records).
 	Entries     fifo.EntryList
-	QueueBefore []fifo.Asset
-	QueueAfter  []fifo.Asset
+	QueueBefore []fifo.Snapshot
+	QueueAfter  []fifo.Snapshot
 	Error       string
 	Warning     string
 }
 
 type Withdrawal struct {
-	RecID       string
-	Ts          time.Time
-	Type        string
-	Account     string
-	Asset       string
-	Amount      decimal.Decimal
-	Fee         decimal.Decimal
-	FeeEur      decimal.Decimal
-	Destination string
-	Entries     fifo.EntryList
-	QueueBefore []fifo.Asset
-	QueueAfter  []fifo.Asset
-	Error       string
-	Warning     string
+	RecID               string
+	Ts                  time.Time
+	Type                string
+	Account             string
+	Asset               string
+	Amount              decimal.Decimal
+	Fee                 decimal.Decimal
+	FeeEur              decimal.Decimal
+	Destination         string
+	Address             string            // Raw destination address, if the destination was found in the address book.
+	NeedsClassification bool              // The assets went to an address that is not one of our own wallets.
+	Classification      string            // What happened to the assets, if they didn't arrive in another account. See WithdrawalClass.
+	Result              *ConversionResult // Only set for withdrawals that are taxable disposals.
+	TxHash              string            // On-chain transaction hash, if the exchange exported one.
+	Deposits            []string          // RecIDs of the deposits that received the withdrawn assets.
+	Entries             fifo.EntryList
+	QueueBefore         []fifo.Snapshot
+	QueueAfter          []fifo.Snapshot
+	Error               string
+	Warning             string
+	remaining           fifo.EntryList // Lots that haven't been claimed by a deposit yet.
+	unclaimed           d.Decimal      // Units that haven't been claimed by a deposit yet.
+	toOwnWallet         bool           // The destination address is in the address book.
 }
 
 type Conversion struct {
@@ -61,10 +75,11 @@ type Conversion struct {
 	FromAmountEur    d.Decimal // = ValueC
 	FromAmountNetEur d.Decimal // = ValueC - FeeC
 	FromEntries      []fifo.Asset
-	QueueBefore      []fifo.Asset
-	QueueAfter       []fifo.Asset
+	QueueBefore      []fifo.Snapshot
+	QueueAfter       []fifo.Snapshot
 	Price            d.Decimal // = Price
 	PriceEur         d.Decimal // = PriceC (only in there for informational purposes)
+	PriceSource      string    // Where the EUR prices came from. Either the host's converter or the local price sources.
 	FeeCurrency      string    // = FeeCurrency
 	Fee              d.Decimal // = Fee
 	FeeDecimals      int32     // = Number of decimals of the fee currency.
@@ -89,7 +104,9 @@ type ConversionResult struct {
 }
 
 // Create a conversion from a trade. Depending on the direction of the trade, assets and prices are assigned accordingly.
-func (r *Generator) TradeToConversion(trade *proto.Trade) *Conversion {
+func (r *Ledger) TradeToConversion(trade *proto.Trade) *Conversion {
+	trade, priceSource, priceWarning := r.fillMissingPrices(trade)
+
 	if trade.Action == proto.TxAction_BUY {
 		toFee := D(trade.Fee.Amount).Abs()
 		toFeeC := D(trade.Fee.AmountC).Abs()
@@ -98,6 +115,8 @@ func (r *Generator) TradeToConversion(trade *proto.Trade) *Conversion {
 
 		return &Conversion{
 			RecID:            trade.TxID,
+			PriceSource:      priceSource,
+			Warning:          priceWarning,
 			Ts:               trade.Ts.AsTime(),
 			Type:             "conversion",
 			Account:          trade.Account,
@@ -105,23 +124,23 @@ func (r *Generator) TradeToConversion(trade *proto.Trade) *Conversion {
 			ToDecimals:       trade.AssetDecimals,
 			From:             trade.Quote,
 			FromDecimals:     trade.QuoteDecimals,
-			Price:            D(trade.Price).Round(IfThen(trade.QuoteDecimals > 0, trade.QuoteDecimals, 8)),
-			PriceEur:         D(trade.PriceC).Round(4),
-			ToAmount:         D(trade.Amount).Round(IfThen(trade.AssetDecimals > 0, trade.AssetDecimals, 8)),
-			ToAmountNet:      D(trade.Amount).Sub(toFee).Round(IfThen(trade.AssetDecimals > 0, trade.AssetDecimals, 8)),
-			ToAmountEur:      D(trade.Amount).Mul(D(trade.PriceC)).Round(4),
-			ToAmountNetEur:   D(trade.Amount).Mul(D(trade.PriceC)).Sub(toFeeC).Round(4),
-			FromAmount:       D(trade.Value).Round(IfThen(trade.QuoteDecimals > 0, trade.QuoteDecimals, 8)),
-			FromAmountNet:    D(trade.Value).Sub(fromFee).Round(IfThen(trade.QuoteDecimals > 0, trade.QuoteDecimals, 8)),
-			FromAmountEur:    D(trade.ValueC).Round(4),
-			FromAmountNetEur: D(trade.ValueC).Sub(fromFeeC).Round(4),
+			Price:            RoundUnits(trade.Quote, D(trade.Price), trade.QuoteDecimals),
+			PriceEur:         RoundUnitPrice(D(trade.PriceC)),
+			ToAmount:         RoundUnits(trade.Asset, D(trade.Amount), trade.AssetDecimals),
+			ToAmountNet:      RoundUnits(trade.Asset, D(trade.Amount).Sub(toFee), trade.AssetDecimals),
+			ToAmountEur:      RoundEur(D(trade.Amount).Mul(D(trade.PriceC))),
+			ToAmountNetEur:   RoundEur(D(trade.Amount).Mul(D(trade.PriceC)).Sub(toFeeC)),
+			FromAmount:       RoundUnits(trade.Quote, D(trade.Value), trade.QuoteDecimals),
+			FromAmountNet:    RoundUnits(trade.Quote, D(trade.Value).Sub(fromFee), trade.QuoteDecimals),
+			FromAmountEur:    RoundEur(D(trade.ValueC)),
+			FromAmountNetEur: RoundEur(D(trade.ValueC).Sub(fromFeeC)),
 			FeeCurrency:      trade.Fee.Currency,
-			Fee:              D(trade.Fee.Amount).Round(IfThen(trade.Fee.Decimals > 0, trade.Fee.Decimals, 8)),
+			Fee:              RoundUnits(trade.Fee.Currency, D(trade.Fee.Amount), trade.Fee.Decimals),
 			FeeDecimals:      trade.Fee.Decimals,
 			QuoteFeeCurrency: trade.QuoteFee.Currency,
-			QuoteFee:         D(trade.QuoteFee.Amount).Round(IfThen(trade.QuoteFee.Decimals > 0, trade.QuoteFee.Decimals, 8)),
+			QuoteFee:         RoundUnits(trade.QuoteFee.Currency, D(trade.QuoteFee.Amount), trade.QuoteFee.Decimals),
 			QuoteFeeDecimals: trade.QuoteFee.Decimals,
-			FeeEur:           D(trade.Fee.AmountC).Add(D(trade.QuoteFee.AmountC)).Round(4),
+			FeeEur:           RoundEur(D(trade.Fee.AmountC).Add(D(trade.QuoteFee.AmountC))),
 			IsDerivative:     trade.Props.IsDerivative,
 			IsMarginTrade:    trade.Props.IsMarginTrade,
 			IsPhysical:       trade.Props.IsPhysical,
@@ -160,6 +179,8 @@ func (r *Generator) TradeToConversion(trade *proto.Trade) *Conversion {
 
 		c := &Conversion{
 			RecID:          trade.TxID,
+			PriceSource:    priceSource,
+			Warning:        priceWarning,
 			Ts:             trade.Ts.AsTime(),
 			Type:           "conversion",
 			Account:        trade.Account,
@@ -168,31 +189,31 @@ func (r *Generator) TradeToConversion(trade *proto.Trade) *Conversion {
 			From:           trade.Asset,
 			FromDecimals:   trade.AssetDecimals,
 			Price:          price,
-			PriceEur:       priceC.Round(4),
-			ToAmount:       toAmount.Round(IfThen(trade.QuoteDecimals > 0, trade.QuoteDecimals, 8)),
-			ToAmountNet:    toAmount.Sub(toFee).Round(IfThen(trade.QuoteDecimals > 0, trade.QuoteDecimals, 8)),
-			ToAmountEur:    toAmount.Mul(D(trade.QuotePriceC)).Round(4),
-			ToAmountNetEur: toAmount.Mul(D(trade.QuotePriceC)).Sub(toFeeC).Round(4),
+			PriceEur:       RoundUnitPrice(priceC),
+			ToAmount:       RoundUnits(trade.Quote, toAmount, trade.QuoteDecimals),
+			ToAmountNet:    RoundUnits(trade.Quote, toAmount.Sub(toFee), trade.QuoteDecimals),
+			ToAmountEur:    RoundEur(toAmount.Mul(D(trade.QuotePriceC))),
+			ToAmountNetEur: RoundEur(toAmount.Mul(D(trade.QuotePriceC)).Sub(toFeeC)),
 			// ToAmount:         toAmount.Sub(toFee).Round(IfThen(trade.QuoteDecimals > 0, trade.QuoteDecimals, 8)),
 			// ToAmountEur:      toAmount.Mul(D(trade.QuotePriceC)).Sub(toFeeC).Round(4),
 			FromAmount:       value,
 			FromAmountNet:    value.Sub(fromFee),
-			FromAmountEur:    value.Round(4),
-			FromAmountNetEur: value.Sub(fromFeeC).Round(4),
+			FromAmountEur:    RoundEur(value),
+			FromAmountNetEur: RoundEur(value.Sub(fromFeeC)),
 			FeeCurrency:      trade.Fee.Currency,
 			Fee:              D(trade.Fee.Amount),
 			FeeDecimals:      trade.Fee.Decimals,
 			QuoteFeeCurrency: trade.QuoteFee.Currency,
 			QuoteFee:         D(trade.QuoteFee.Amount),
 			QuoteFeeDecimals: trade.QuoteFee.Decimals,
-			FeeEur:           D(trade.Fee.AmountC).Add(D(trade.QuoteFee.AmountC)).Round(4),
+			FeeEur:           RoundEur(D(trade.Fee.AmountC).Add(D(trade.QuoteFee.AmountC))),
 			IsDerivative:     trade.Props.IsDerivative,
 			IsMarginTrade:    trade.Props.IsMarginTrade,
 			IsPhysical:       trade.Props.IsPhysical,
 		}
 
-		if priceC.GreaterThan(d.Zero) && trade.Asset != "EUR" {
-			c.FromAmountEur = toAmount.Div(priceC).Round(4)
+		if priceC.GreaterThan(d.Zero) && !IsCash(trade.Asset) {
+			c.FromAmountEur = RoundEur(toAmount.Div(priceC))
 		}
 
 		// d, _ = json.MarshalIndent(c, "", "  ")
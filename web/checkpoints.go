@@ -0,0 +1,57 @@
+package web
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/f-taxes/german_tax_report/conf"
+	"github.com/f-taxes/german_tax_report/reporting"
+	"github.com/kataras/golog"
+)
+
+// Oldest year a checkpoint is looked for.
+const firstCheckpointYear = 2001
+
+// A generator restored from the latest checkpoint at or before the given year, along with the time to stream
+// records from, which is the start of the checkpoint's year. Each checkpoint is tried on a fresh generator, so a
+// failed attempt leaves nothing behind. Returns false if there is no usable checkpoint.
+func resumeFromCheckpoint(year int) (*reporting.Generator, time.Time, bool) {
+	for y := year; y >= firstCheckpointYear; y-- {
+		var data json.RawMessage
+
+		if err := conf.LoadJSON(reporting.CheckpointFile(y), &data); err != nil {
+			golog.Errorf("Failed to load checkpoint for %d: %v", y, err)
+			continue
+		}
+
+		if data == nil {
+			continue
+		}
+
+		generator := newGenerator()
+
+		cp, err := generator.Resume(data)
+		if err != nil {
+			golog.Errorf("Failed to resume from checkpoint for %d: %v", y, err)
+			continue
+		}
+
+		golog.Infof("Resuming report generation from checkpoint for %d", cp.Year)
+		return generator, cp.From.In(time.UTC), true
+	}
+
+	return nil, time.Time{}, false
+}
+
+func saveCheckpoints(generator *reporting.Generator) {
+	checkpoints, err := generator.Checkpoints()
+	if err != nil {
+		golog.Errorf("Failed to create checkpoint: %v", err)
+	}
+
+	for year, data := range checkpoints {
+		if err := conf.SaveJSON(reporting.CheckpointFile(year), json.RawMessage(data)); err != nil {
+			golog.Errorf("Failed to save checkpoint for %d: %v", year, err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package web
+
+import (
+	"github.com/f-taxes/german_tax_report/conf"
+	"github.com/f-taxes/german_tax_report/global"
+	"github.com/f-taxes/german_tax_report/reporting"
+	"github.com/kataras/golog"
+	"github.com/kataras/iris/v12"
+)
+
+const withdrawalClassesFile = "withdrawal_classes.json"
+
+func loadWithdrawalClasses() reporting.WithdrawalClasses {
+	classes := reporting.WithdrawalClasses{}
+
+	if err := conf.LoadJSON(withdrawalClassesFile, &classes); err != nil {
+		golog.Errorf("Failed to load withdrawal classifications: %v", err)
+	}
+
+	return classes
+}
+
+func registerClassRoutes(app *iris.Application) {
+	app.Get("/report/classes", func(ctx iris.Context) {
+		ctx.JSON(global.Resp{
+			Result: true,
+			Data:   loadWithdrawalClasses(),
+		})
+	})
+
+	app.Post("/report/classes", func(ctx iris.Context) {
+		class := reporting.WithdrawalClass{}
+
+		if !global.ReadJSON(ctx, &class) {
+			return
+		}
+
+		if class.Withdrawal == "" || (class.Class != reporting.CLASS_PAYMENT && class.Class != reporting.CLASS_GIFT) {
+			ctx.StopWithStatus(iris.StatusBadRequest)
+			return
+		}
+
+		saveJSON(ctx, withdrawalClassesFile, loadWithdrawalClasses().Set(class))
+	})
+
+	app.Post("/report/classes/delete", func(ctx iris.Context) {
+		reqData := struct {
+			Withdrawal string `json:"withdrawal"`
+		}{}
+
+		if !global.ReadJSON(ctx, &reqData) {
+			return
+		}
+
+		saveJSON(ctx, withdrawalClassesFile, loadWithdrawalClasses().Remove(reqData.Withdrawal))
+	})
+}
@@ -0,0 +1,132 @@
+package web
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/f-taxes/german_tax_report/conf"
+	"github.com/f-taxes/german_tax_report/global"
+	"github.com/f-taxes/german_tax_report/reporting"
+	"github.com/kataras/iris/v12"
+)
+
+// The report generation that is running, if any. Only one report is generated at a time.
+var generation = struct {
+	sync.Mutex
+	cancel    context.CancelFunc
+	generator *reporting.Generator // Generator of the running or last generation.
+}{}
+
+// A generator set up with the user's settings.
+func newGenerator() *reporting.Generator {
+	generator := reporting.NewGenerator()
+	generator.Links = loadTransferLinks()
+	generator.AddressBook = reporting.NewAddressBook(conf.App.StringMap("addressBook"))
+	generator.Classes = loadWithdrawalClasses()
+	generator.OpeningBalances = loadOpeningBalances()
+	generator.FxRates = loadFxRates()
+	generator.Prices = loadPrices()
+	generator.DustThresholds = loadDustThresholds()
+	generator.NegativeBalances = conf.App.Bool("negativeBalances")
+	generator.PlaceholderFallback = conf.App.String("negativeBalanceFallback", reporting.FALLBACK_ZERO)
+
+	return generator
+}
+
+// A generator set up for a report, restored from the latest checkpoint if resume is set. Returns the time
+// to stream records from.
+func prepareGenerator(year int, resume bool) (*reporting.Generator, time.Time) {
+	if resume {
+		if generator, from, ok := resumeFromCheckpoint(year); ok {
+			return generator, from
+		}
+	}
+
+	return newGenerator(), reporting.YearStart(2000).In(time.UTC)
+}
+
+// Generate the report from the given time up to the end of the year and save the checkpoints taken along the way.
+func generate(ctx context.Context, generator *reporting.Generator, year int, from time.Time) error {
+	gerTZ, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		return err
+	}
+
+	to := time.Date(year, time.December, 31, 23, 59, 59, 0, gerTZ).In(time.UTC)
+
+	if err := generator.Start(ctx, from, to); err != nil {
+		return err
+	}
+
+	saveCheckpoints(generator)
+
+	return nil
+}
+
+// Derive the context of a new report generation from the request's. Returns false if another generation is running.
+func startGeneration(parent context.Context, generator *reporting.Generator) (context.Context, bool) {
+	generation.Lock()
+	defer generation.Unlock()
+
+	if generation.cancel != nil {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	generation.cancel = cancel
+	generation.generator = generator
+
+	return ctx, true
+}
+
+func finishGeneration() {
+	generation.Lock()
+	defer generation.Unlock()
+
+	if generation.cancel != nil {
+		generation.cancel()
+		generation.cancel = nil
+	}
+}
+
+// Cancel the running report generation. Returns false if there is none.
+func cancelGeneration() bool {
+	generation.Lock()
+	defer generation.Unlock()
+
+	if generation.cancel == nil {
+		return false
+	}
+
+	generation.cancel()
+	return true
+}
+
+func registerGenerationRoutes(app *iris.Application) {
+	// Progress of the running or last report generation.
+	app.Get("/report/progress", func(ctx iris.Context) {
+		generation.Lock()
+		generator := generation.generator
+		generation.Unlock()
+
+		if generator == nil {
+			ctx.JSON(global.Resp{
+				Result: false,
+			})
+			return
+		}
+
+		ctx.JSON(global.Resp{
+			Result: true,
+			Data:   generator.Progress(),
+		})
+	})
+
+	// Cancel the running report generation. The generate request or job then fails.
+	app.Post("/report/cancel", func(ctx iris.Context) {
+		ctx.JSON(global.Resp{
+			Result: cancelGeneration(),
+		})
+	})
+}
@@ -0,0 +1,447 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/f-taxes/german_tax_report/conf"
+	"github.com/f-taxes/german_tax_report/global"
+	"github.com/f-taxes/german_tax_report/reporting"
+	"github.com/kataras/golog"
+	"github.com/kataras/iris/v12"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	reportJobsFile = "report_jobs.json"
+	reportsDir     = "reports" // Results of finished jobs, one file per job.
+)
+
+const (
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// Page sizes of job results.
+const (
+	defaultPageSize = 500
+	maxPageSize     = 5000
+)
+
+// reportJob is a report generation running in the background. Its result is stored on disk once it's done.
+type reportJob struct {
+	ID       string
+	Year     int
+	Resume   bool
+	Status   string
+	Error    string
+	Created  time.Time
+	Finished time.Time
+	Records  int                 // Number of records in the result.
+	Progress *reporting.Progress `json:",omitempty"` // Only set while the job is running.
+}
+
+type reportJobs []reportJob
+
+// Guards the job list, which is read and written by requests and running jobs.
+var jobsLock sync.Mutex
+
+// storedReport is a report as stored on disk. Records and matches are kept as raw json, so they can be paged
+// through without decoding all of them.
+type storedReport struct {
+	Records   []json.RawMessage
+	Ordering  string
+	Matches   []json.RawMessage
+	Gains     json.RawMessage
+	FxGains   json.RawMessage
+	Residuals json.RawMessage
+}
+
+// The last result read from disk. Paging through a result reads it once instead of for every page.
+var resultCache = struct {
+	sync.Mutex
+	id     string
+	report *storedReport
+}{}
+
+func loadReportJobs() reportJobs {
+	jobs := reportJobs{}
+
+	if err := conf.LoadJSON(reportJobsFile, &jobs); err != nil {
+		golog.Errorf("Failed to load report jobs: %v", err)
+	}
+
+	return jobs
+}
+
+func (j reportJobs) Get(id string) (reportJob, bool) {
+	for _, job := range j {
+		if job.ID == id {
+			return job, true
+		}
+	}
+
+	return reportJob{}, false
+}
+
+// Set adds the job or replaces the one with the same ID.
+func (j reportJobs) Set(job reportJob) reportJobs {
+	return append(j.Remove(job.ID), job)
+}
+
+func (j reportJobs) Remove(id string) reportJobs {
+	out := reportJobs{}
+
+	for _, job := range j {
+		if job.ID != id {
+			out = append(out, job)
+		}
+	}
+
+	return out
+}
+
+// Change the stored job list.
+func updateReportJobs(update func(jobs reportJobs) reportJobs) error {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+
+	return conf.SaveJSON(reportJobsFile, update(loadReportJobs()))
+}
+
+func reportFile(id string) string {
+	return filepath.Join(reportsDir, id+".json")
+}
+
+// Jobs still running according to the job list were interrupted when the plugin stopped.
+func failInterruptedJobs() {
+	err := updateReportJobs(func(jobs reportJobs) reportJobs {
+		for i := range jobs {
+			if jobs[i].Status == jobRunning {
+				jobs[i].Status = jobFailed
+				jobs[i].Error = "Interrupted by a restart of the plugin."
+			}
+		}
+
+		return jobs
+	})
+
+	if err != nil {
+		golog.Errorf("Failed to update report jobs: %v", err)
+	}
+}
+
+// Start a report generation in the background. Returns false if another generation is running.
+func startReportJob(year int, resume bool) (reportJob, bool) {
+	generator, from := prepareGenerator(year, resume)
+
+	ctx, ok := startGeneration(context.Background(), generator)
+	if !ok {
+		return reportJob{}, false
+	}
+
+	job := reportJob{
+		ID:      fmt.Sprintf("%d-%d", year, time.Now().UnixNano()),
+		Year:    year,
+		Resume:  resume,
+		Status:  jobRunning,
+		Created: time.Now(),
+	}
+
+	if err := updateReportJobs(func(jobs reportJobs) reportJobs { return jobs.Set(job) }); err != nil {
+		golog.Errorf("Failed to save report job %s: %v", job.ID, err)
+	}
+
+	go func() {
+		defer finishGeneration()
+
+		err := generate(ctx, generator, year, from)
+		finishReportJob(ctx, job, generator, err)
+	}()
+
+	return job, true
+}
+
+// Store the result of a job and update its status. The result is stored while holding the job list, so a job
+// deleted while it was running doesn't leave a result behind.
+func finishReportJob(ctx context.Context, job reportJob, generator *reporting.Generator, err error) {
+	var report reporting.Report
+
+	if err == nil {
+		report = generator.Report()
+	}
+
+	updateErr := updateReportJobs(func(jobs reportJobs) reportJobs {
+		// The job was deleted while it was running.
+		if _, ok := jobs.Get(job.ID); !ok {
+			return jobs
+		}
+
+		job.Finished = time.Now()
+		job.Status = jobDone
+
+		if err == nil {
+			job.Records = len(report.Records)
+			err = saveReport(job.ID, report)
+		}
+
+		if err != nil {
+			golog.Errorf("Report job %s failed: %v", job.ID, err)
+			job.Status = jobFailed
+			job.Error = err.Error()
+
+			if cancelled(ctx, err) {
+				job.Status = jobCancelled
+			}
+		}
+
+		return jobs.Set(job)
+	})
+
+	if updateErr != nil {
+		golog.Errorf("Failed to save report job %s: %v", job.ID, updateErr)
+	}
+}
+
+// A generation fails with whatever error it got when it was cancelled. Fetching data from the main app fails with a
+// gRPC status then, rather than the context's error.
+func cancelled(ctx context.Context, err error) bool {
+	return ctx.Err() != nil || errors.Is(err, context.Canceled) || status.Code(err) == codes.Canceled
+}
+
+func saveReport(id string, report reporting.Report) error {
+	if err := os.MkdirAll(filepath.Join(conf.Dir(), reportsDir), 0755); err != nil {
+		return err
+	}
+
+	return conf.SaveJSON(reportFile(id), report)
+}
+
+func loadReport(id string) (*storedReport, error) {
+	resultCache.Lock()
+	defer resultCache.Unlock()
+
+	if resultCache.id == id {
+		return resultCache.report, nil
+	}
+
+	// Only finished jobs have a result. Checking the job list also keeps the ID from pointing anywhere else.
+	if job, ok := loadReportJobs().Get(id); !ok || job.Status != jobDone {
+		return nil, fmt.Errorf("no result for report job %q", id)
+	}
+
+	report := &storedReport{}
+
+	if err := conf.LoadJSON(reportFile(id), report); err != nil {
+		return nil, err
+	}
+
+	resultCache.id = id
+	resultCache.report = report
+
+	return report, nil
+}
+
+// Delete a job and its result. A running job is cancelled.
+func deleteReportJob(id string) error {
+	job, ok := loadReportJobs().Get(id)
+	if !ok {
+		return nil
+	}
+
+	if job.Status == jobRunning {
+		cancelGeneration()
+	}
+
+	// The job is removed first, so a job finishing in the meantime doesn't store its result anymore
+	// and the result can't be cached again.
+	if err := updateReportJobs(func(jobs reportJobs) reportJobs { return jobs.Remove(id) }); err != nil {
+		return err
+	}
+
+	resultCache.Lock()
+	if resultCache.id == id {
+		resultCache.id = ""
+		resultCache.report = nil
+	}
+	resultCache.Unlock()
+
+	if err := os.Remove(filepath.Join(conf.Dir(), reportFile(id))); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// A page of items, given by the offset and limit url parameters.
+func page(ctx iris.Context, items []json.RawMessage) any {
+	offset := ctx.URLParamIntDefault("offset", 0)
+	limit := ctx.URLParamIntDefault("limit", defaultPageSize)
+
+	offset = min(max(offset, 0), len(items))
+	limit = min(max(limit, 1), maxPageSize)
+
+	return struct {
+		Total  int
+		Offset int
+		Items  []json.RawMessage
+	}{
+		Total:  len(items),
+		Offset: offset,
+		Items:  items[offset:min(offset+limit, len(items))],
+	}
+}
+
+func registerJobRoutes(app *iris.Application) {
+	failInterruptedJobs()
+
+	// All jobs, the latest first.
+	app.Get("/report/jobs", func(ctx iris.Context) {
+		jobs := loadReportJobs()
+
+		sort.SliceStable(jobs, func(i, j int) bool {
+			return jobs[i].Created.After(jobs[j].Created)
+		})
+
+		ctx.JSON(global.Resp{
+			Result: true,
+			Data:   jobs,
+		})
+	})
+
+	// Start generating a report. Returns the job, which is polled for its status.
+	app.Post("/report/jobs", func(ctx iris.Context) {
+		reqData := struct {
+			Year   int  `json:"year"`
+			Resume bool `json:"resume"` // Continue from the latest checkpoint instead of processing all records.
+		}{}
+
+		if !global.ReadJSON(ctx, &reqData) {
+			return
+		}
+
+		job, ok := startReportJob(reqData.Year, reqData.Resume)
+		if !ok {
+			golog.Error("A report is being generated already")
+			ctx.JSON(global.Resp{
+				Result: false,
+			})
+			return
+		}
+
+		ctx.JSON(global.Resp{
+			Result: true,
+			Data:   job,
+		})
+	})
+
+	app.Get("/report/jobs/{id:string}", func(ctx iris.Context) {
+		job, ok := loadReportJobs().Get(ctx.Params().Get("id"))
+		if !ok {
+			ctx.StopWithStatus(iris.StatusNotFound)
+			return
+		}
+
+		if job.Status == jobRunning {
+			generation.Lock()
+			if generation.generator != nil {
+				progress := generation.generator.Progress()
+				job.Progress = &progress
+			}
+			generation.Unlock()
+		}
+
+		ctx.JSON(global.Resp{
+			Result: true,
+			Data:   job,
+		})
+	})
+
+	// Records of a finished job, page by page.
+	app.Get("/report/jobs/{id:string}/records", func(ctx iris.Context) {
+		report, err := loadReport(ctx.Params().Get("id"))
+		if err != nil {
+			golog.Errorf("Failed to load report: %v", err)
+			ctx.JSON(global.Resp{
+				Result: false,
+			})
+			return
+		}
+
+		ctx.JSON(global.Resp{
+			Result: true,
+			Data:   page(ctx, report.Records),
+		})
+	})
+
+	// Lot matches of a finished job, page by page.
+	app.Get("/report/jobs/{id:string}/matches", func(ctx iris.Context) {
+		report, err := loadReport(ctx.Params().Get("id"))
+		if err != nil {
+			golog.Errorf("Failed to load report: %v", err)
+			ctx.JSON(global.Resp{
+				Result: false,
+			})
+			return
+		}
+
+		ctx.JSON(global.Resp{
+			Result: true,
+			Data:   page(ctx, report.Matches),
+		})
+	})
+
+	// Everything of a finished job's report but its records and lot matches.
+	app.Get("/report/jobs/{id:string}/summary", func(ctx iris.Context) {
+		report, err := loadReport(ctx.Params().Get("id"))
+		if err != nil {
+			golog.Errorf("Failed to load report: %v", err)
+			ctx.JSON(global.Resp{
+				Result: false,
+			})
+			return
+		}
+
+		ctx.JSON(global.Resp{
+			Result: true,
+			Data: struct {
+				Ordering  string
+				Gains     json.RawMessage
+				FxGains   json.RawMessage
+				Residuals json.RawMessage
+			}{report.Ordering, report.Gains, report.FxGains, report.Residuals},
+		})
+	})
+
+	app.Post("/report/jobs/delete", func(ctx iris.Context) {
+		reqData := struct {
+			ID string `json:"id"`
+		}{}
+
+		if !global.ReadJSON(ctx, &reqData) {
+			return
+		}
+
+		if err := deleteReportJob(reqData.ID); err != nil {
+			golog.Errorf("Failed to delete report job %s: %v", reqData.ID, err)
+			ctx.JSON(global.Resp{
+				Result: false,
+			})
+			return
+		}
+
+		ctx.JSON(global.Resp{
+			Result: true,
+		})
+	})
+}
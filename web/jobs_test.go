@@ -0,0 +1,242 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/f-taxes/german_tax_report/conf"
+	"github.com/f-taxes/german_tax_report/reporting"
+	"github.com/kataras/iris/v12"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type testResp struct {
+	Result bool            `json:"result"`
+	Data   json.RawMessage `json:"data"`
+}
+
+type testPage struct {
+	Total  int
+	Offset int
+	Items  []map[string]string
+}
+
+// Point the config directory at a fresh temporary directory and serve the job routes.
+func setupJobs(t *testing.T, jobs ...reportJob) *httptest.Server {
+	dir := t.TempDir()
+	cfg := filepath.Join(dir, "config.yml")
+	require.NoError(t, os.WriteFile(cfg, []byte("debug: false\n"), 0644))
+	conf.LoadAppConfig(cfg)
+
+	resultCache.id = ""
+	resultCache.report = nil
+
+	for _, job := range jobs {
+		require.NoError(t, updateReportJobs(func(list reportJobs) reportJobs { return list.Set(job) }))
+	}
+
+	app := iris.New()
+	registerJobRoutes(app)
+	require.NoError(t, app.Build())
+
+	srv := httptest.NewServer(app)
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func getJSON(t *testing.T, srv *httptest.Server, path string, v any) int {
+	res, err := http.Get(srv.URL + path)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(res.Body).Decode(v))
+	}
+
+	return res.StatusCode
+}
+
+func postJSON(t *testing.T, srv *httptest.Server, path string, body any, v any) {
+	data, err := json.Marshal(body)
+	require.NoError(t, err)
+
+	res, err := http.Post(srv.URL+path, "application/json", bytes.NewReader(data))
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.NoError(t, json.NewDecoder(res.Body).Decode(v))
+}
+
+func runningJob(id string) reportJob {
+	return reportJob{ID: id, Year: 2024, Status: jobRunning, Created: time.Now()}
+}
+
+// A generator that produced the given records.
+func finishedGenerator(recIDs ...string) *reporting.Generator {
+	generator := reporting.NewGenerator()
+
+	for _, id := range recIDs {
+		generator.Recs = append(generator.Recs, map[string]string{"RecID": id})
+	}
+
+	return generator
+}
+
+func TestReportJobs(t *testing.T) {
+	t.Run("stored result is paged", func(t *testing.T) {
+		job := runningJob("2024-1")
+		srv := setupJobs(t, job)
+		finishReportJob(context.Background(), job, finishedGenerator("r1", "r2", "r3"), nil)
+
+		resp := testResp{}
+		require.Equal(t, http.StatusOK, getJSON(t, srv, "/report/jobs/2024-1", &resp))
+		stored := reportJob{}
+		require.NoError(t, json.Unmarshal(resp.Data, &stored))
+		assert.Equal(t, jobDone, stored.Status)
+		assert.Equal(t, 3, stored.Records)
+		assert.False(t, stored.Finished.IsZero())
+
+		getJSON(t, srv, "/report/jobs/2024-1/records?offset=1&limit=1", &resp)
+		require.True(t, resp.Result)
+		p := testPage{}
+		require.NoError(t, json.Unmarshal(resp.Data, &p))
+		assert.Equal(t, 3, p.Total)
+		assert.Equal(t, 1, p.Offset)
+		assert.Equal(t, []map[string]string{{"RecID": "r2"}}, p.Items)
+
+		// Offsets past the end result in an empty page.
+		getJSON(t, srv, "/report/jobs/2024-1/records?offset=10", &resp)
+		require.NoError(t, json.Unmarshal(resp.Data, &p))
+		assert.Equal(t, 3, p.Offset)
+		assert.Empty(t, p.Items)
+
+		getJSON(t, srv, "/report/jobs/2024-1/summary", &resp)
+		require.True(t, resp.Result)
+		summary := map[string]any{}
+		require.NoError(t, json.Unmarshal(resp.Data, &summary))
+		assert.Equal(t, reporting.RECORD_ORDERING, summary["Ordering"])
+		assert.Contains(t, summary, "FxGains")
+	})
+
+	t.Run("list of jobs, the latest first", func(t *testing.T) {
+		older := runningJob("2023-1")
+		older.Created = time.Now().Add(-time.Hour)
+		srv := setupJobs(t, older, runningJob("2024-1"))
+
+		resp := testResp{}
+		getJSON(t, srv, "/report/jobs", &resp)
+		jobs := reportJobs{}
+		require.NoError(t, json.Unmarshal(resp.Data, &jobs))
+		require.Len(t, jobs, 2)
+		assert.Equal(t, "2024-1", jobs[0].ID)
+		assert.Equal(t, "2023-1", jobs[1].ID)
+
+		// Both were running when the routes were registered, so they were interrupted.
+		assert.Equal(t, jobFailed, jobs[0].Status)
+		assert.Equal(t, jobFailed, jobs[1].Status)
+	})
+
+	t.Run("unknown job", func(t *testing.T) {
+		srv := setupJobs(t)
+
+		resp := testResp{}
+		assert.Equal(t, http.StatusNotFound, getJSON(t, srv, "/report/jobs/nope", &resp))
+
+		getJSON(t, srv, "/report/jobs/nope/records", &resp)
+		assert.False(t, resp.Result)
+	})
+
+	t.Run("job without a result", func(t *testing.T) {
+		srv := setupJobs(t)
+		require.NoError(t, updateReportJobs(func(jobs reportJobs) reportJobs { return jobs.Set(runningJob("2024-1")) }))
+
+		resp := testResp{}
+		getJSON(t, srv, "/report/jobs/2024-1/records", &resp)
+		assert.False(t, resp.Result)
+
+		getJSON(t, srv, "/report/jobs/2024-1/matches", &resp)
+		assert.False(t, resp.Result)
+	})
+
+	t.Run("deleting a job removes its result", func(t *testing.T) {
+		job := runningJob("2024-1")
+		srv := setupJobs(t, job)
+		finishReportJob(context.Background(), job, finishedGenerator("r1"), nil)
+
+		// Cache the result.
+		resp := testResp{}
+		getJSON(t, srv, "/report/jobs/2024-1/records", &resp)
+		require.True(t, resp.Result)
+
+		postJSON(t, srv, "/report/jobs/delete", map[string]string{"id": "2024-1"}, &resp)
+		assert.True(t, resp.Result)
+
+		assert.Equal(t, http.StatusNotFound, getJSON(t, srv, "/report/jobs/2024-1", &resp))
+		getJSON(t, srv, "/report/jobs/2024-1/records", &resp)
+		assert.False(t, resp.Result)
+		assert.NoFileExists(t, filepath.Join(conf.Dir(), reportFile("2024-1")))
+	})
+}
+
+func TestFinishReportJob(t *testing.T) {
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		err    error
+		status string
+	}{
+		{"done", context.Background(), nil, jobDone},
+		{"failed", context.Background(), errors.New("no records"), jobFailed},
+		{"context cancelled", context.Background(), context.Canceled, jobCancelled},
+		{"gRPC call cancelled", context.Background(), status.Error(codes.Canceled, "context canceled"), jobCancelled},
+		{"failed after being cancelled", cancelledCtx, errors.New("stream closed"), jobCancelled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := runningJob("2024-1")
+			setupJobs(t, job)
+			finishReportJob(tt.ctx, job, finishedGenerator("r1"), tt.err)
+
+			stored, ok := loadReportJobs().Get(job.ID)
+			require.True(t, ok)
+			assert.Equal(t, tt.status, stored.Status)
+
+			if tt.err == nil {
+				assert.Empty(t, stored.Error)
+				assert.FileExists(t, filepath.Join(conf.Dir(), reportFile(job.ID)))
+			} else {
+				assert.Equal(t, tt.err.Error(), stored.Error)
+				assert.NoFileExists(t, filepath.Join(conf.Dir(), reportFile(job.ID)))
+			}
+		})
+	}
+
+	t.Run("job deleted while it was running", func(t *testing.T) {
+		job := runningJob("2024-1")
+		setupJobs(t, job)
+
+		require.NoError(t, deleteReportJob(job.ID))
+		finishReportJob(context.Background(), job, finishedGenerator("r1"), nil)
+
+		_, ok := loadReportJobs().Get(job.ID)
+		assert.False(t, ok)
+		assert.NoFileExists(t, filepath.Join(conf.Dir(), reportFile(job.ID)))
+	})
+}
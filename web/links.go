@@ -0,0 +1,58 @@
+package web
+
+import (
+	"github.com/f-taxes/german_tax_report/conf"
+	"github.com/f-taxes/german_tax_report/global"
+	"github.com/f-taxes/german_tax_report/reporting"
+	"github.com/kataras/golog"
+	"github.com/kataras/iris/v12"
+)
+
+const transferLinksFile = "transfer_links.json"
+
+func loadTransferLinks() reporting.TransferLinks {
+	links := reporting.TransferLinks{}
+
+	if err := conf.LoadJSON(transferLinksFile, &links); err != nil {
+		golog.Errorf("Failed to load transfer links: %v", err)
+	}
+
+	return links
+}
+
+func registerLinkRoutes(app *iris.Application) {
+	app.Get("/report/links", func(ctx iris.Context) {
+		ctx.JSON(global.Resp{
+			Result: true,
+			Data:   loadTransferLinks(),
+		})
+	})
+
+	app.Post("/report/links", func(ctx iris.Context) {
+		link := reporting.TransferLink{}
+
+		if !global.ReadJSON(ctx, &link) {
+			return
+		}
+
+		if link.Withdrawal == "" || link.Deposit == "" {
+			ctx.StopWithStatus(iris.StatusBadRequest)
+			return
+		}
+
+		saveJSON(ctx, transferLinksFile, loadTransferLinks().Set(link))
+	})
+
+	app.Post("/report/links/delete", func(ctx iris.Context) {
+		reqData := struct {
+			Withdrawal string `json:"withdrawal"`
+			Deposit    string `json:"deposit"`
+		}{}
+
+		if !global.ReadJSON(ctx, &reqData) {
+			return
+		}
+
+		saveJSON(ctx, transferLinksFile, loadTransferLinks().Remove(reqData.Withdrawal, reqData.Deposit))
+	})
+}
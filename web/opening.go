@@ -0,0 +1,64 @@
+package web
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/f-taxes/german_tax_report/conf"
+	"github.com/f-taxes/german_tax_report/global"
+	"github.com/f-taxes/german_tax_report/reporting"
+	"github.com/kataras/golog"
+	"github.com/kataras/iris/v12"
+)
+
+const openingBalancesFile = "opening_balances.json"
+
+func loadOpeningBalances() reporting.OpeningBalances {
+	balances := reporting.OpeningBalances{}
+
+	if err := conf.LoadJSON(openingBalancesFile, &balances); err != nil {
+		golog.Errorf("Failed to load opening balances: %v", err)
+	}
+
+	return balances
+}
+
+func registerOpeningBalanceRoutes(app *iris.Application) {
+	app.Get("/report/opening-balances", func(ctx iris.Context) {
+		ctx.JSON(global.Resp{
+			Result: true,
+			Data:   loadOpeningBalances(),
+		})
+	})
+
+	app.Post("/report/opening-balances", func(ctx iris.Context) {
+		balance := reporting.OpeningBalance{}
+
+		if !global.ReadJSON(ctx, &balance) {
+			return
+		}
+
+		if balance.Account == "" || balance.Asset == "" || !global.D(balance.Units).IsPositive() || global.D(balance.CostEur).IsNegative() {
+			ctx.StopWithStatus(iris.StatusBadRequest)
+			return
+		}
+
+		if balance.ID == "" {
+			balance.ID = strconv.FormatInt(time.Now().UnixNano(), 36)
+		}
+
+		saveJSON(ctx, openingBalancesFile, loadOpeningBalances().Set(balance))
+	})
+
+	app.Post("/report/opening-balances/delete", func(ctx iris.Context) {
+		reqData := struct {
+			ID string `json:"id"`
+		}{}
+
+		if !global.ReadJSON(ctx, &reqData) {
+			return
+		}
+
+		saveJSON(ctx, openingBalancesFile, loadOpeningBalances().Remove(reqData.ID))
+	})
+}
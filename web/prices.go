@@ -0,0 +1,119 @@
+package web
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/f-taxes/german_tax_report/conf"
+	"github.com/f-taxes/german_tax_report/global"
+	"github.com/f-taxes/german_tax_report/prices"
+	"github.com/kataras/golog"
+	"github.com/kataras/iris/v12"
+)
+
+var assetNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func pricesDir() string {
+	return filepath.Join(conf.Dir(), prices.DIR)
+}
+
+func loadPrices() *prices.Prices {
+	p, err := prices.Load(pricesDir())
+	if err != nil {
+		golog.Errorf("Failed to load price database: %v", err)
+		return nil
+	}
+
+	return p
+}
+
+func registerPriceRoutes(app *iris.Application) {
+	app.Get("/prices", func(ctx iris.Context) {
+		p := loadPrices()
+
+		if p == nil {
+			ctx.JSON(global.Resp{
+				Result: false,
+			})
+			return
+		}
+
+		ctx.JSON(global.Resp{
+			Result: true,
+			Data:   p.Coverage(),
+		})
+	})
+
+	// Import daily EUR prices of an asset. New prices are merged into the ones already stored.
+	app.Post("/prices/import", func(ctx iris.Context) {
+		reqData := struct {
+			Asset string `json:"asset"`
+			Csv   string `json:"csv"`
+		}{}
+
+		if !global.ReadJSON(ctx, &reqData) {
+			return
+		}
+
+		if !assetNamePattern.MatchString(reqData.Asset) {
+			ctx.StopWithStatus(iris.StatusBadRequest)
+			return
+		}
+
+		file := filepath.Join(pricesDir(), reqData.Asset+".csv")
+		p := prices.New()
+
+		// Prices already stored are kept. A file that can't be read back would otherwise be replaced by the new prices alone.
+		existing, err := os.Open(file)
+		if err == nil {
+			err = p.Import(reqData.Asset, existing)
+			existing.Close()
+		} else if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+
+		if err != nil {
+			golog.Errorf("Failed to read stored prices for %s: %v", reqData.Asset, err)
+			ctx.JSON(global.Resp{
+				Result: false,
+			})
+			return
+		}
+
+		if err := p.Import(reqData.Asset, strings.NewReader(reqData.Csv)); err != nil {
+			golog.Errorf("Failed to import prices for %s: %v", reqData.Asset, err)
+			ctx.JSON(global.Resp{
+				Result: false,
+			})
+			return
+		}
+
+		buf := new(bytes.Buffer)
+		err = p.Write(reqData.Asset, buf)
+
+		if err == nil {
+			err = os.MkdirAll(pricesDir(), 0755)
+		}
+
+		if err == nil {
+			err = os.WriteFile(file, buf.Bytes(), 0644)
+		}
+
+		if err != nil {
+			golog.Errorf("Failed to save prices for %s: %v", reqData.Asset, err)
+			ctx.JSON(global.Resp{
+				Result: false,
+			})
+			return
+		}
+
+		ctx.JSON(global.Resp{
+			Result: true,
+			Data:   p.Coverage(),
+		})
+	})
+}
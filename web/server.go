@@ -3,14 +3,16 @@ package web
 import (
 	"embed"
 	"net/http"
-	"time"
+	"path/filepath"
+	"strconv"
 
 	"github.com/f-taxes/german_tax_report/conf"
 	"github.com/f-taxes/german_tax_report/global"
-	"github.com/f-taxes/german_tax_report/reporting"
+	"github.com/f-taxes/german_tax_report/rates"
 	"github.com/kataras/golog"
 	"github.com/kataras/iris/v12"
 	"github.com/kataras/iris/v12/view"
+	d "github.com/shopspring/decimal"
 )
 
 func Start(address string, webAssets embed.FS) {
@@ -20,6 +22,8 @@ func Start(address string, webAssets embed.FS) {
 		golog.Info("Debug logging is enabled!")
 	}
 
+	global.Precision.Units = loadUnitDecimals()
+
 	app := iris.New()
 	app.Use(iris.Compression)
 	app.SetRoutesNoLog(true)
@@ -28,39 +32,97 @@ func Start(address string, webAssets embed.FS) {
 
 	app.Post("/report/generate", func(ctx iris.Context) {
 		reqData := struct {
-			Year int `json:"year"`
+			Year   int  `json:"year"`
+			Resume bool `json:"resume"` // Continue from the latest checkpoint instead of processing all records.
 		}{}
 
 		if !global.ReadJSON(ctx, &reqData) {
 			return
 		}
 
-		gerTZ, err := time.LoadLocation("Europe/Berlin")
-		if err != nil {
-			golog.Error(err)
+		generator, from := prepareGenerator(reqData.Year, reqData.Resume)
+
+		genCtx, ok := startGeneration(ctx.Request().Context(), generator)
+		if !ok {
+			golog.Error("A report is being generated already")
 			ctx.JSON(global.Resp{
 				Result: false,
 			})
 			return
 		}
 
-		from := time.Date(2000, time.January, 1, 0, 0, 0, 0, gerTZ).In(time.UTC)
-		to := time.Date(reqData.Year, time.December, 31, 23, 59, 59, 0, gerTZ).In(time.UTC)
-		generator := reporting.NewGenerator()
+		defer finishGeneration()
 
-		generator.Start(from, to)
+		if err := generate(genCtx, generator, reqData.Year, from); err != nil {
+			golog.Errorf("Failed to generate report: %v", err)
+			ctx.JSON(global.Resp{
+				Result: false,
+			})
+			return
+		}
 
 		ctx.JSON(global.Resp{
 			Result: true,
-			Data:   generator.Recs,
+			Data:   generator.Report(),
 		})
 	})
 
+	registerGenerationRoutes(app)
+	registerJobRoutes(app)
+	registerLinkRoutes(app)
+	registerClassRoutes(app)
+	registerOpeningBalanceRoutes(app)
+	registerPriceRoutes(app)
+
 	if err := app.Listen(address); err != nil {
 		golog.Fatal(err)
 	}
 }
 
+func loadFxRates() *rates.Rates {
+	fxRates, err := rates.Load(filepath.Join(conf.Dir(), rates.ECB_FILE))
+	if err != nil {
+		golog.Warnf("No EUR reference rates available: %v", err)
+		return nil
+	}
+
+	return fxRates
+}
+
+// Decimals configured for specific assets, overriding what the records say.
+func loadUnitDecimals() map[string]int32 {
+	units := map[string]int32{}
+
+	for asset, v := range conf.App.StringMap("unitDecimals") {
+		decimals, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			golog.Warnf("Ignoring invalid number of decimals %q for %s", v, asset)
+			continue
+		}
+
+		units[asset] = int32(decimals)
+	}
+
+	return units
+}
+
+// Per asset amounts below which holdings are written off as dust.
+func loadDustThresholds() map[string]d.Decimal {
+	thresholds := map[string]d.Decimal{}
+
+	for asset, v := range conf.App.StringMap("dustThresholds") {
+		threshold, ok := global.DOk(v)
+		if !ok {
+			golog.Warnf("Ignoring invalid dust threshold %q for %s", v, asset)
+			continue
+		}
+
+		thresholds[asset] = threshold
+	}
+
+	return thresholds
+}
+
 func registerFrontend(app *iris.Application, webAssets embed.FS) {
 	var frontendTpl *view.HTMLEngine
 	useEmbedded := conf.App.Bool("embedded")
@@ -88,3 +150,19 @@ func registerFrontend(app *iris.Application, webAssets embed.FS) {
 func index(ctx iris.Context) {
 	ctx.View("index.html")
 }
+
+// Write data into a json file in the config directory and respond with the saved data.
+func saveJSON(ctx iris.Context, name string, data any) {
+	if err := conf.SaveJSON(name, data); err != nil {
+		golog.Errorf("Failed to save %s: %v", name, err)
+		ctx.JSON(global.Resp{
+			Result: false,
+		})
+		return
+	}
+
+	ctx.JSON(global.Resp{
+		Result: true,
+		Data:   data,
+	})
+}